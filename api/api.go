@@ -0,0 +1,151 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	"github.com/moira-alert/cache/logging"
+)
+
+// NewHandler creates HTTP API handler with health and readiness endpoints,
+// other endpoints are registered on returned mux
+func NewHandler(readiness *Readiness) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, &status{Status: statusOK})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		result := readiness.Check()
+		code := http.StatusOK
+		if result.Status != statusOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, result)
+	})
+	return mux
+}
+
+// Serve serves HTTP API on listen address until terminate
+// listening is retried while address is busy, e.g. by parent process during graceful restart
+func Serve(listen string, handler http.Handler, terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var (
+		l   net.Listener
+		err error
+	)
+	for {
+		if l, err = net.Listen("tcp", listen); err == nil {
+			break
+		}
+		logging.Errorf("failed to listen api on [%s]: %s", listen, err.Error())
+		select {
+		case <-terminate:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	logging.Infof("api listening on %s", listen)
+	go func() {
+		<-terminate
+		l.Close()
+	}()
+	if err := http.Serve(l, handler); err != nil {
+		select {
+		case <-terminate:
+		default:
+			logging.Errorf("api stopped: %s", err.Error())
+		}
+	}
+}
+
+// authorized checks that request changing state carries "Authorization: Bearer <token>" header,
+// only clients on loopback interface may change state if token is not configured
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && ip.IsLoopback()
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.Errorf("failed to write api response: %s", err.Error())
+	}
+}
+
+// RejectsHandler serves recent rejected metric lines
+func RejectsHandler(rejects *filter.RejectLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, rejects.Recent())
+	})
+}
+
+// SourcesHandler serves line counters of connected and recently disconnected sources
+func SourcesHandler(limiter *filter.ConnectionLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, limiter.Sources())
+	})
+}
+
+// RewriteHandler serves dry run of rewrite rules for metric parameter
+func RewriteHandler(rewriter *filter.Rewriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metric := r.FormValue("metric")
+		if metric == "" {
+			http.Error(w, "metric parameter is required", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, rewriter.DryRun(metric))
+	})
+}
+
+// FilterHandler serves number of metrics matched by every name filter rule
+func FilterHandler(nameFilter *filter.NameFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, nameFilter.Stats())
+	})
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// LogLevelHandler serves logger level, PUT or POST with level parameter changes it if request is authorized by token
+func LogLevelHandler(logger *logging.Logger, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			if !authorized(r, token) {
+				http.Error(w, "valid api token is required to change log level", http.StatusUnauthorized)
+				return
+			}
+			level, err := logging.ParseLevel(r.FormValue("level"))
+			if err != nil || r.FormValue("level") == "" {
+				http.Error(w, "level must be one of debug, info, warning, error or fatal", http.StatusBadRequest)
+				return
+			}
+			logger.SetLevel(level)
+			logging.Infof("log level is %s", level)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, &logLevel{Level: logger.Level().String()})
+	})
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const metricsNamespace = "moira_cache"
+
+var (
+	summaryQuantiles   = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+	summarySuffixes    = []string{"_sum", "_count"}
+	invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+)
+
+// MetricsHandler serves go-metrics registry and Go runtime stats in Prometheus text exposition format
+func MetricsHandler(registry metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		out := bufio.NewWriter(w)
+		writeRegistry(out, registry)
+		writeRuntime(out)
+		out.Flush()
+	})
+}
+
+func prometheusName(name string) string {
+	return fmt.Sprintf("%s_%s", metricsNamespace, invalidMetricChars.ReplaceAllString(name, "_"))
+}
+
+func counterName(name string) string {
+	if strings.HasSuffix(name, "_total") {
+		return name
+	}
+	return name + "_total"
+}
+
+func writeRegistry(out *bufio.Writer, registry metrics.Registry) {
+	all := make(map[string]interface{})
+	registry.Each(func(name string, metric interface{}) {
+		all[name] = metric
+	})
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	used := make(map[string]bool)
+	for _, name := range names {
+		promName := prometheusName(name)
+		switch metric := all[name].(type) {
+		case metrics.Counter:
+			writeSample(out, uniqueName(used, strings.TrimSuffix(promName, "_total"), counterName), "counter", float64(metric.Count()))
+		case metrics.Gauge:
+			writeSample(out, uniqueName(used, promName, gaugeName), "gauge", float64(metric.Value()))
+		case metrics.GaugeFloat64:
+			writeSample(out, uniqueName(used, promName, gaugeName), "gauge", metric.Value())
+		case metrics.Meter:
+			writeSample(out, uniqueName(used, strings.TrimSuffix(promName, "_total"), counterName), "counter", float64(metric.Count()))
+		case metrics.Timer:
+			snapshot := metric.Snapshot()
+			writeSummary(out, uniqueName(used, promName, timerName, summarySuffixes...), snapshot.Percentiles(summaryQuantiles), float64(snapshot.Sum()), snapshot.Count(), float64(time.Second))
+		case metrics.Histogram:
+			snapshot := metric.Snapshot()
+			writeSummary(out, uniqueName(used, promName, gaugeName, summarySuffixes...), snapshot.Percentiles(summaryQuantiles), float64(snapshot.Sum()), snapshot.Count(), 1)
+		}
+	}
+}
+
+func gaugeName(name string) string {
+	return name
+}
+
+func timerName(name string) string {
+	return name + "_seconds"
+}
+
+// uniqueName returns exposed name of metric which is not used by previous metrics together with its suffixed series,
+// names equal after sanitizing, e.g. a.b and a_b, get numeric suffix in registry order
+func uniqueName(used map[string]bool, name string, expose func(string) string, suffixes ...string) string {
+	exposed := expose(name)
+	for i := 2; isUsed(used, exposed, suffixes); i++ {
+		exposed = expose(fmt.Sprintf("%s_%d", name, i))
+	}
+	used[exposed] = true
+	for _, suffix := range suffixes {
+		used[exposed+suffix] = true
+	}
+	return exposed
+}
+
+func isUsed(used map[string]bool, name string, suffixes []string) bool {
+	if used[name] {
+		return true
+	}
+	for _, suffix := range suffixes {
+		if used[name+suffix] {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSample(out *bufio.Writer, name, kind string, value float64) {
+	fmt.Fprintf(out, "# TYPE %s %s\n%s %g\n", name, kind, name, value)
+}
+
+// writeSummary writes quantiles and sum divided by scale to convert them to base units
+func writeSummary(out *bufio.Writer, name string, quantiles []float64, sum float64, count int64, scale float64) {
+	fmt.Fprintf(out, "# TYPE %s summary\n", name)
+	for i, quantile := range summaryQuantiles {
+		fmt.Fprintf(out, "%s{quantile=\"%g\"} %g\n", name, quantile, quantiles[i]/scale)
+	}
+	fmt.Fprintf(out, "%s_sum %g\n%s_count %d\n", name, sum/scale, name, count)
+}
+
+func writeRuntime(out *bufio.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	writeSample(out, "go_goroutines", "gauge", float64(runtime.NumGoroutine()))
+	writeSample(out, "go_memstats_alloc_bytes", "gauge", float64(stats.Alloc))
+	writeSample(out, "go_memstats_alloc_bytes_total", "counter", float64(stats.TotalAlloc))
+	writeSample(out, "go_memstats_sys_bytes", "gauge", float64(stats.Sys))
+	writeSample(out, "go_memstats_heap_inuse_bytes", "gauge", float64(stats.HeapInuse))
+	writeSample(out, "go_memstats_heap_objects", "gauge", float64(stats.HeapObjects))
+	writeSample(out, "go_memstats_mallocs_total", "counter", float64(stats.Mallocs))
+	writeSample(out, "go_memstats_frees_total", "counter", float64(stats.Frees))
+	writeSample(out, "go_memstats_last_gc_time_seconds", "gauge", float64(stats.LastGC)/float64(time.Second))
+	writeSample(out, "go_gc_cycles_total", "counter", float64(stats.NumGC))
+	writeSample(out, "go_gc_pause_seconds_total", "counter", float64(stats.PauseTotalNs)/float64(time.Second))
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+)
+
+const (
+	statusOK       = "ok"
+	statusNotReady = "not_ready"
+)
+
+type check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type status struct {
+	Status string  `json:"status"`
+	Checks []check `json:"checks,omitempty"`
+}
+
+// Readiness checks cache instance is able to receive and save metrics
+type Readiness struct {
+	Patterns *filter.PatternStorage
+	Cache    *filter.CacheStorage
+	Storage  filter.WriteTracker
+	Shards   *filter.MetricShards
+	// MaxWriteAge is maximum time since the last successful storage write
+	MaxWriteAge time.Duration
+	// MaxQueueFill is maximum ratio of buffered metrics to save shard buffer size
+	MaxQueueFill float64
+}
+
+// Check runs all readiness checks
+func (readiness *Readiness) Check() *status {
+	checks := []check{
+		readiness.checkPatterns(),
+		readiness.checkRetentions(),
+		readiness.checkStorage(),
+		readiness.checkQueue(),
+	}
+	result := &status{Status: statusOK, Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			result.Status = statusNotReady
+		}
+	}
+	return result
+}
+
+func (readiness *Readiness) checkPatterns() check {
+	c := check{Name: "patterns"}
+	if readiness.Patterns == nil || readiness.Patterns.LastRefresh().IsZero() {
+		c.Detail = "pattern tree is not loaded"
+		return c
+	}
+	c.OK = true
+	c.Detail = fmt.Sprintf("%d patterns loaded %s ago", readiness.Patterns.PatternsCount(), since(readiness.Patterns.LastRefresh()))
+	return c
+}
+
+func (readiness *Readiness) checkRetentions() check {
+	c := check{Name: "retentions"}
+	if readiness.Cache == nil {
+		c.Detail = "retentions are not parsed"
+		return c
+	}
+	c.OK = true
+	c.Detail = fmt.Sprintf("%d retentions parsed", readiness.Cache.RetentionsCount())
+	return c
+}
+
+func (readiness *Readiness) checkStorage() check {
+	c := check{Name: "storage"}
+	if readiness.Storage == nil {
+		c.Detail = "storage is not connected"
+		return c
+	}
+	lastWrite := readiness.Storage.LastWrite()
+	if lastWrite.IsZero() {
+		c.Detail = "storage was never written"
+		return c
+	}
+	c.OK = time.Since(lastWrite) <= readiness.MaxWriteAge
+	c.Detail = fmt.Sprintf("last write %s ago", since(lastWrite))
+	return c
+}
+
+func (readiness *Readiness) checkQueue() check {
+	c := check{Name: "queue"}
+	if readiness.Shards == nil {
+		c.Detail = "save queue is not started"
+		return c
+	}
+	fill := readiness.Shards.Fill()
+	c.OK = fill < readiness.MaxQueueFill
+	c.Detail = fmt.Sprintf("save queue is %.0f%% full", fill*100)
+	return c
+}
+
+func since(t time.Time) time.Duration {
+	return time.Since(t) / time.Millisecond * time.Millisecond
+}
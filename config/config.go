@@ -0,0 +1,329 @@
+// Package config reads cache configuration file with defaults, environment overrides and validation
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is cache configuration file
+type Config struct {
+	Cache    CacheConfig    `yaml:"cache"`
+	Redis    RedisConfig    `yaml:"redis"`
+	Memory   MemoryConfig   `yaml:"memory"`
+	Graphite GraphiteConfig `yaml:"graphite"`
+	Spool    SpoolConfig    `yaml:"spool"`
+	API      APIConfig      `yaml:"api"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	ACL      ACLConfig      `yaml:"acl"`
+	Filter   FilterConfig   `yaml:"filter"`
+
+	unknownKeys []string
+	ignoredEnv  []string
+	// unsupportedEnv maps ignored environment variables to keys which can be set in configuration file only
+	unsupportedEnv map[string]string
+}
+
+// CacheConfig is cache section of configuration
+type CacheConfig struct {
+	Listen              string `yaml:"listen"`
+	Instance            string `yaml:"instance"`
+	Pid                 string `yaml:"pid"`
+	LogOutput           string `yaml:"log_output"`
+	LogFile             string `yaml:"log_file"`
+	LogLevel            string `yaml:"log_level"`
+	LogFormat           string `yaml:"log_format"`
+	Storage             string `yaml:"storage"`
+	RetentionConfig     string `yaml:"retention-config"`
+	RewriteRules        string `yaml:"rewrite_rules"`
+	CacheMemoryLimit    int64  `yaml:"cache_memory_limit"`
+	CacheTTL            int64  `yaml:"cache_ttl"`
+	SaveShards          int    `yaml:"save_shards"`
+	SaveBuffer          int    `yaml:"save_buffer"`
+	SaveBatchSize       int    `yaml:"save_batch_size"`
+	SaveFlushIntervalMs int64  `yaml:"save_flush_interval_ms"`
+	OverflowPolicy      string `yaml:"overflow_policy"`
+	DrainTimeout        int64  `yaml:"drain_timeout"`
+	RejectsLogRate      int    `yaml:"rejects_log_rate"`
+}
+
+// RedisConfig is redis section of configuration
+type RedisConfig struct {
+	Host               string   `yaml:"host"`
+	Port               int      `yaml:"port"`
+	DbID               int      `yaml:"dbid"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	TLS                bool     `yaml:"tls"`
+	TLSCAFile          string   `yaml:"tls_ca_file"`
+	TLSCertFile        string   `yaml:"tls_cert_file"`
+	TLSKeyFile         string   `yaml:"tls_key_file"`
+	TLSSkipVerify      bool     `yaml:"tls_skip_verify"`
+	ConnectTimeoutMs   int64    `yaml:"connect_timeout_ms"`
+	ReadTimeoutMs      int64    `yaml:"read_timeout_ms"`
+	WriteTimeoutMs     int64    `yaml:"write_timeout_ms"`
+	MaxIdle            int      `yaml:"max_idle"`
+	MaxActive          int      `yaml:"max_active"`
+	Sentinels          []string `yaml:"sentinels"`
+	MasterName         string   `yaml:"master_name"`
+	SentinelUsername   string   `yaml:"sentinel_username"`
+	SentinelPassword   string   `yaml:"sentinel_password"`
+	SentinelTLS        bool     `yaml:"sentinel_tls"`
+	Cluster            []string `yaml:"cluster"`
+	MaxRetries         int      `yaml:"max_retries"`
+	RetryBackoffMs     int64    `yaml:"retry_backoff_ms"`
+	MetricsTTL         int64    `yaml:"metrics_ttl"`
+	KeyTTL             int64    `yaml:"key_ttl"`
+	TrimSampling       int      `yaml:"trim_sampling"`
+	EventsVersion      int      `yaml:"events_version"`
+	EventsTransport    string   `yaml:"events_transport"`
+	EventsStream       string   `yaml:"events_stream"`
+	EventsStreamMaxLen int64    `yaml:"events_stream_max_len"`
+	EventsPayload      string   `yaml:"events_payload"`
+	EventsEncoding     string   `yaml:"events_encoding"`
+	SelfStateTTL       int64    `yaml:"selfstate_ttl"`
+}
+
+// MemoryConfig is memory storage section of configuration
+type MemoryConfig struct {
+	MetricsTTL int64    `yaml:"metrics_ttl"`
+	Patterns   []string `yaml:"patterns"`
+}
+
+// GraphiteConfig is internal metrics reporting section of configuration
+type GraphiteConfig struct {
+	URI      string `yaml:"uri"`
+	Prefix   string `yaml:"prefix"`
+	Interval int64  `yaml:"interval"`
+	// TimingSampleRate is how often received lines are timed by parse, stages and match timers
+	TimingSampleRate int64 `yaml:"timing_sample_rate"`
+}
+
+// SpoolConfig is spool section of configuration
+type SpoolConfig struct {
+	Dir       string `yaml:"dir"`
+	MaxSizeMb int64  `yaml:"max_size_mb"`
+	MaxAge    int64  `yaml:"max_age"`
+}
+
+// APIConfig is HTTP API section of configuration
+type APIConfig struct {
+	Listen            string  `yaml:"listen"`
+	ReadyMaxWriteAge  int64   `yaml:"ready_max_write_age"`
+	ReadyMaxQueueFill float64 `yaml:"ready_max_queue_fill"`
+	// Token authorizes requests changing state, only loopback clients may change it if token is empty
+	Token string `yaml:"token"`
+}
+
+// LimitsConfig is incoming connections limits section of configuration, zero disables limit
+type LimitsConfig struct {
+	MaxConnections     int     `yaml:"max_connections"`
+	IPLineRate         float64 `yaml:"ip_line_rate"`
+	ConnectionLineRate float64 `yaml:"connection_line_rate"`
+	MaxLineLength      int     `yaml:"max_line_length"`
+	IdleTimeout        int64   `yaml:"idle_timeout"`
+}
+
+// FilterConfig is metric names filter section of configuration, it is disabled without globs and regexps
+type FilterConfig struct {
+	Mode    string   `yaml:"mode"`
+	Globs   []string `yaml:"globs"`
+	Regexps []string `yaml:"regexps"`
+	// NewNamesRate limits matched metric names not received for NewNamesTTL seconds per second, zero disables limit
+	NewNamesRate float64 `yaml:"new_names_rate"`
+	NewNamesTTL  int64   `yaml:"new_names_ttl"`
+	// NewNamesWarmup is number of seconds after start all names are accepted and remembered without limit
+	NewNamesWarmup int64 `yaml:"new_names_warmup"`
+}
+
+// ACLConfig is source networks allowlist section of configuration, it is disabled without rules
+type ACLConfig struct {
+	Rules []ACLRuleConfig `yaml:"rules"`
+}
+
+// ACLRuleConfig allows sources from networks to send metrics with prefixes or matching globs
+type ACLRuleConfig struct {
+	Name     string   `yaml:"name"`
+	Networks []string `yaml:"networks"`
+	Prefixes []string `yaml:"prefixes"`
+	Globs    []string `yaml:"globs"`
+}
+
+// ACLRules returns parsed ACL rules
+func (config *Config) ACLRules() ([]*filter.ACLRule, error) {
+	rules := make([]*filter.ACLRule, 0, len(config.ACL.Rules))
+	for _, ruleConfig := range config.ACL.Rules {
+		rule, err := filter.NewACLRule(ruleConfig.Name, ruleConfig.Networks, ruleConfig.Prefixes, ruleConfig.Globs)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// NameFilter returns metric names filter or nil if it has no rules
+func (config *Config) NameFilter() (*filter.NameFilter, error) {
+	if len(config.Filter.Globs) == 0 && len(config.Filter.Regexps) == 0 {
+		return nil, nil
+	}
+	mode, err := filter.ParseFilterMode(config.Filter.Mode)
+	if err != nil {
+		return nil, err
+	}
+	return filter.NewNameFilter(mode, config.Filter.Globs, config.Filter.Regexps)
+}
+
+// NewNamesLimiter returns limiter of new metric names rate or nil if it is disabled
+func (config *Config) NewNamesLimiter() *filter.NewNamesLimiter {
+	if config.Filter.NewNamesRate <= 0 {
+		return nil
+	}
+	return filter.NewNewNamesLimiter(config.Filter.NewNamesRate, time.Duration(config.Filter.NewNamesTTL)*time.Second,
+		time.Duration(config.Filter.NewNamesWarmup)*time.Second)
+}
+
+// Default returns configuration used for keys missing in configuration file
+func Default() *Config {
+	return &Config{
+		Cache: CacheConfig{
+			Listen:              ":2003",
+			Pid:                 "/var/run/moira/moira-cache.pid",
+			LogLevel:            "info",
+			LogFormat:           "logfmt",
+			Storage:             "redis",
+			RetentionConfig:     "/etc/moira/storage-schemas.conf",
+			CacheMemoryLimit:    256,
+			CacheTTL:            3600,
+			SaveShards:          4,
+			SaveBuffer:          10,
+			SaveBatchSize:       10,
+			SaveFlushIntervalMs: 1000,
+			OverflowPolicy:      "block",
+			DrainTimeout:        30,
+			RejectsLogRate:      10,
+		},
+		Redis: RedisConfig{
+			Host:               "localhost",
+			Port:               6379,
+			ConnectTimeoutMs:   5000,
+			ReadTimeoutMs:      5000,
+			WriteTimeoutMs:     5000,
+			MaxRetries:         3,
+			RetryBackoffMs:     100,
+			TrimSampling:       10,
+			EventsVersion:      1,
+			EventsTransport:    "pubsub",
+			EventsStream:       "moira-metric-events",
+			EventsStreamMaxLen: 1000000,
+			EventsPayload:      "basic",
+			EventsEncoding:     "json",
+			SelfStateTTL:       60,
+		},
+		Graphite: GraphiteConfig{
+			Prefix:           "DevOps.moira",
+			Interval:         60,
+			TimingSampleRate: 1,
+		},
+		Spool: SpoolConfig{
+			MaxSizeMb: 1024,
+			MaxAge:    3600,
+		},
+		Filter: FilterConfig{
+			Mode:           "deny",
+			NewNamesTTL:    3600,
+			NewNamesWarmup: 3600,
+		},
+		API: APIConfig{
+			ReadyMaxWriteAge:  30,
+			ReadyMaxQueueFill: 0.9,
+		},
+	}
+}
+
+// Load reads configuration file over defaults, applies environment overrides and validates result
+func Load(fileName string) (*Config, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read config file [%s]: %s", fileName, err.Error())
+	}
+	config := Default()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Can't parse config file [%s]: %s", fileName, err.Error())
+	}
+	if config.unknownKeys, err = unknownKeys(data, config); err != nil {
+		return nil, fmt.Errorf("Can't parse config file [%s]: %s", fileName, err.Error())
+	}
+	if err := config.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LogOutputName returns log output, file if it is not set and log file is
+func (config *Config) LogOutputName() string {
+	if config.Cache.LogOutput == "" && config.Cache.LogFile != "" {
+		return "file"
+	}
+	return config.Cache.LogOutput
+}
+
+// Warnings returns messages about unknown keys and ignored environment variables
+func (config *Config) Warnings() []string {
+	warnings := make([]string, 0, len(config.unknownKeys)+len(config.ignoredEnv))
+	for _, key := range config.unknownKeys {
+		warnings = append(warnings, fmt.Sprintf("unknown config key %s", key))
+	}
+	for _, variable := range config.ignoredEnv {
+		if key, ok := config.unsupportedEnv[variable]; ok {
+			warnings = append(warnings, fmt.Sprintf("ignored environment variable %s, %s can be set in config file only", variable, key))
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("ignored environment variable %s", variable))
+	}
+	return warnings
+}
+
+// UnknownKeys returns keys of known sections missing in Config, they are mistyped or used by other Moira services
+func (config *Config) UnknownKeys() []string {
+	return config.unknownKeys
+}
+
+func unknownKeys(data []byte, config *Config) ([]string, error) {
+	known := make(map[string]bool)
+	config.eachKey(func(section, key string, value reflect.Value) {
+		known[section+"."+key] = true
+		known[section] = true
+	})
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	unknown := make([]string, 0)
+	for section, keys := range raw {
+		if !known[section] {
+			continue
+		}
+		keysMap, ok := keys.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		for key := range keysMap {
+			if name := fmt.Sprintf("%s.%v", section, key); !known[name] {
+				unknown = append(unknown, name)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
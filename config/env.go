@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is prefix of environment variables overriding configuration keys,
+// e.g. MOIRA_CACHE_REDIS_HOST overrides host key of redis section
+const EnvPrefix = "MOIRA_CACHE_"
+
+// EnvName returns environment variable name overriding key of section
+func EnvName(section, key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(section+"_"+key, "-", "_", -1))
+}
+
+// serviceLinkValue matches values of Kubernetes service link variables, e.g. MOIRA_CACHE_PORT=tcp://10.0.0.1:2003
+var serviceLinkValue = regexp.MustCompile(`^(tcp|udp|sctp)://`)
+
+// ApplyEnv overrides configuration keys by environment variables in os.Environ format,
+// list keys are comma separated. Unknown variables and service link values of non-string keys are ignored
+// and returned by IgnoredEnv, since Kubernetes adds MOIRA_CACHE_* service links for service named moira-cache.
+// Variables of keys which are neither scalars nor string lists, e.g. acl rules, are ignored too
+func (config *Config) ApplyEnv(environ []string) error {
+	fields := make(map[string]reflect.Value)
+	keys := make(map[string]string)
+	config.eachKey(func(section, key string, value reflect.Value) {
+		fields[EnvName(section, key)] = value
+		keys[EnvName(section, key)] = section + "." + key
+	})
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field, ok := fields[parts[0]]
+		if !ok {
+			config.ignoredEnv = append(config.ignoredEnv, parts[0])
+			continue
+		}
+		if field.Kind() != reflect.String && serviceLinkValue.MatchString(parts[1]) {
+			config.ignoredEnv = append(config.ignoredEnv, parts[0])
+			continue
+		}
+		if !envSupported(field) {
+			if config.unsupportedEnv == nil {
+				config.unsupportedEnv = make(map[string]string)
+			}
+			config.unsupportedEnv[parts[0]] = keys[parts[0]]
+			config.ignoredEnv = append(config.ignoredEnv, parts[0])
+			continue
+		}
+		if err := setString(field, parts[1]); err != nil {
+			return fmt.Errorf("invalid config environment variable %s: %s", parts[0], err.Error())
+		}
+	}
+	return nil
+}
+
+// eachKey calls f with section name, key name and value of every configuration key
+func (config *Config) eachKey(f func(section, key string, value reflect.Value)) {
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			f(sectionName, section.Type().Field(j).Tag.Get("yaml"), section.Field(j))
+		}
+	}
+}
+
+// envSupported checks that key can be set from environment variable by setString
+func envSupported(field reflect.Value) bool {
+	switch field.Kind() {
+	case reflect.String, reflect.Int, reflect.Int64, reflect.Float64, reflect.Bool:
+		return true
+	case reflect.Slice:
+		return field.Type().Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+func setString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		list := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// IgnoredEnv returns MOIRA_CACHE_* environment variables not applied as config keys
+func (config *Config) IgnoredEnv() []string {
+	return config.ignoredEnv
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/moira-alert/cache/filter"
+	"github.com/moira-alert/cache/logging"
+)
+
+// ValidationError lists all invalid configuration keys
+type ValidationError struct {
+	Problems []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(err.Problems, "; "))
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) check(err error, key string) {
+	if err != nil {
+		v.errorf("%s: %s", key, err.Error())
+	}
+}
+
+func (v *validator) required(value, key string) {
+	if value == "" {
+		v.errorf("%s is required", key)
+	}
+}
+
+func (v *validator) positive(value int64, key string) {
+	if value <= 0 {
+		v.errorf("%s must be positive, got %d", key, value)
+	}
+}
+
+func (v *validator) notNegative(value int64, key string) {
+	if value < 0 {
+		v.errorf("%s must not be negative, got %d", key, value)
+	}
+}
+
+func (v *validator) address(value, key string) {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		v.errorf("%s must be host:port, got [%s]", key, value)
+	}
+}
+
+// Validate checks all configuration keys and returns ValidationError listing every problem
+func (config *Config) Validate() error {
+	v := &validator{}
+	config.validateCache(v)
+	switch config.Cache.Storage {
+	case "redis":
+		config.validateRedis(v)
+	case "memory":
+		v.notNegative(config.Memory.MetricsTTL, "memory.metrics_ttl")
+	}
+	v.positive(config.Graphite.TimingSampleRate, "graphite.timing_sample_rate")
+	if config.Graphite.URI != "" {
+		v.address(config.Graphite.URI, "graphite.uri")
+		v.positive(config.Graphite.Interval, "graphite.interval")
+	}
+	if config.Spool.Dir != "" {
+		v.positive(config.Spool.MaxSizeMb, "spool.max_size_mb")
+		v.positive(config.Spool.MaxAge, "spool.max_age")
+	}
+	if config.API.Listen != "" {
+		v.address(config.API.Listen, "api.listen")
+		v.positive(config.API.ReadyMaxWriteAge, "api.ready_max_write_age")
+		if config.API.ReadyMaxQueueFill <= 0 || config.API.ReadyMaxQueueFill > 1 {
+			v.errorf("api.ready_max_queue_fill must be in (0, 1], got %g", config.API.ReadyMaxQueueFill)
+		}
+	}
+	config.validateACL(v)
+	_, err := filter.ParseFilterMode(config.Filter.Mode)
+	v.check(err, "filter.mode")
+	_, err = filter.NewNameFilter(filter.FilterDeny, config.Filter.Globs, config.Filter.Regexps)
+	v.check(err, "filter")
+	if config.Filter.NewNamesRate < 0 {
+		v.errorf("filter.new_names_rate must not be negative, got %g", config.Filter.NewNamesRate)
+	}
+	if config.Filter.NewNamesRate > 0 {
+		v.positive(config.Filter.NewNamesTTL, "filter.new_names_ttl")
+		v.notNegative(config.Filter.NewNamesWarmup, "filter.new_names_warmup")
+	}
+	limits := &config.Limits
+	v.notNegative(int64(limits.MaxConnections), "limits.max_connections")
+	if limits.IPLineRate < 0 {
+		v.errorf("limits.ip_line_rate must not be negative, got %g", limits.IPLineRate)
+	}
+	if limits.ConnectionLineRate < 0 {
+		v.errorf("limits.connection_line_rate must not be negative, got %g", limits.ConnectionLineRate)
+	}
+	v.notNegative(int64(limits.MaxLineLength), "limits.max_line_length")
+	v.notNegative(limits.IdleTimeout, "limits.idle_timeout")
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func (config *Config) validateCache(v *validator) {
+	cache := &config.Cache
+	v.required(cache.Listen, "cache.listen")
+	if cache.Listen != "" {
+		v.address(cache.Listen, "cache.listen")
+	}
+	v.required(cache.Pid, "cache.pid")
+	v.required(cache.RetentionConfig, "cache.retention-config")
+	if cache.Storage != "redis" && cache.Storage != "memory" {
+		v.errorf("cache.storage must be redis or memory, got [%s]", cache.Storage)
+	}
+	_, err := logging.ParseLevel(cache.LogLevel)
+	v.check(err, "cache.log_level")
+	_, err = logging.ParseFormat(cache.LogFormat)
+	v.check(err, "cache.log_format")
+	switch config.LogOutputName() {
+	case "", "stdout", "journald":
+	case "file":
+		v.required(cache.LogFile, "cache.log_file")
+	default:
+		v.errorf("cache.log_output must be stdout, journald or file, got [%s]", cache.LogOutput)
+	}
+	v.positive(cache.CacheMemoryLimit, "cache.cache_memory_limit")
+	v.positive(cache.CacheTTL, "cache.cache_ttl")
+	v.positive(int64(cache.SaveShards), "cache.save_shards")
+	v.positive(int64(cache.SaveBuffer), "cache.save_buffer")
+	v.positive(int64(cache.SaveBatchSize), "cache.save_batch_size")
+	v.positive(cache.SaveFlushIntervalMs, "cache.save_flush_interval_ms")
+	v.positive(cache.DrainTimeout, "cache.drain_timeout")
+	v.notNegative(int64(cache.RejectsLogRate), "cache.rejects_log_rate")
+	_, err = filter.ParseOverflowPolicy(cache.OverflowPolicy)
+	v.check(err, "cache.overflow_policy")
+}
+
+func (config *Config) validateRedis(v *validator) {
+	redis := &config.Redis
+	switch {
+	case len(redis.Sentinels) > 0 && len(redis.Cluster) > 0:
+		v.errorf("redis.sentinels and redis.cluster can not be used together")
+	case len(redis.Sentinels) > 0:
+		v.required(redis.MasterName, "redis.master_name")
+		for _, sentinel := range redis.Sentinels {
+			v.address(sentinel, "redis.sentinels")
+		}
+	case len(redis.Cluster) > 0:
+		if redis.DbID != 0 {
+			v.errorf("redis.dbid must be 0 for redis cluster, got %d", redis.DbID)
+		}
+		for _, node := range redis.Cluster {
+			v.address(node, "redis.cluster")
+		}
+	default:
+		v.required(redis.Host, "redis.host")
+		if redis.Port <= 0 || redis.Port > 65535 {
+			v.errorf("redis.port must be in [1, 65535], got %d", redis.Port)
+		}
+	}
+	v.notNegative(int64(redis.DbID), "redis.dbid")
+	if (redis.TLSCertFile == "") != (redis.TLSKeyFile == "") {
+		v.errorf("redis.tls_cert_file and redis.tls_key_file must be set together")
+	}
+	v.positive(redis.ConnectTimeoutMs, "redis.connect_timeout_ms")
+	v.positive(redis.ReadTimeoutMs, "redis.read_timeout_ms")
+	v.positive(redis.WriteTimeoutMs, "redis.write_timeout_ms")
+	v.notNegative(int64(redis.MaxIdle), "redis.max_idle")
+	v.notNegative(int64(redis.MaxActive), "redis.max_active")
+	v.notNegative(int64(redis.MaxRetries), "redis.max_retries")
+	v.positive(redis.RetryBackoffMs, "redis.retry_backoff_ms")
+	v.notNegative(redis.MetricsTTL, "redis.metrics_ttl")
+	v.notNegative(redis.KeyTTL, "redis.key_ttl")
+	v.positive(int64(redis.TrimSampling), "redis.trim_sampling")
+	if redis.EventsVersion != filter.EventsVersionSingle && redis.EventsVersion != filter.EventsVersionBatch {
+		v.errorf("redis.events_version must be %d or %d, got %d", filter.EventsVersionSingle, filter.EventsVersionBatch, redis.EventsVersion)
+	}
+	_, err := filter.ParseEventsTransport(redis.EventsTransport)
+	v.check(err, "redis.events_transport")
+	_, err = filter.ParseEventsPayload(redis.EventsPayload)
+	v.check(err, "redis.events_payload")
+	_, err = filter.ParseEventsEncoding(redis.EventsEncoding)
+	v.check(err, "redis.events_encoding")
+	v.required(redis.EventsStream, "redis.events_stream")
+	v.positive(redis.EventsStreamMaxLen, "redis.events_stream_max_len")
+	v.positive(redis.SelfStateTTL, "redis.selfstate_ttl")
+}
+
+func (config *Config) validateACL(v *validator) {
+	names := make(map[string]bool)
+	for i, rule := range config.ACL.Rules {
+		if names[rule.Name] {
+			v.errorf("acl.rules[%d] name [%s] is not unique", i, rule.Name)
+		}
+		names[rule.Name] = true
+		if strings.Trim(rule.Name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") != "" {
+			v.errorf("acl.rules[%d] name [%s] must consist of letters, digits, _ and -", i, rule.Name)
+		}
+		_, err := filter.NewACLRule(rule.Name, rule.Networks, rule.Prefixes, rule.Globs)
+		v.check(err, fmt.Sprintf("acl.rules[%d]", i))
+	}
+}
@@ -0,0 +1,163 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DropReasonACL is reason of metric dropped because its source is not allowed to send it
+	DropReasonACL = "acl"
+	// aclUnknownSource is name of rejected counter of sources not covered by any rule
+	aclUnknownSource = "unknown_source"
+	// aclSourcesCacheSize is number of source addresses rules are cached for
+	aclSourcesCacheSize = 10000
+)
+
+// ACLRule allows sources from its networks to send metrics with its prefixes or matching its globs
+type ACLRule struct {
+	Name     string
+	Networks []*net.IPNet
+	Prefixes [][]byte
+	Globs    []*Glob
+
+	// rejected counts metrics rejected by rule, it is set by NewACL
+	rejected metrics.Meter
+}
+
+// NewACLRule parses networks in CIDR notation and metric name globs of rule
+func NewACLRule(name string, networks, prefixes, globs []string) (*ACLRule, error) {
+	if name == "" {
+		return nil, fmt.Errorf("acl rule name is required")
+	}
+	rule := &ACLRule{Name: name}
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule [%s]: %s", name, err.Error())
+		}
+		rule.Networks = append(rule.Networks, ipNet)
+	}
+	if len(rule.Networks) == 0 {
+		return nil, fmt.Errorf("acl rule [%s] has no networks", name)
+	}
+	for _, prefix := range prefixes {
+		rule.Prefixes = append(rule.Prefixes, []byte(prefix))
+	}
+	for _, pattern := range globs {
+		glob, err := CompileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule [%s] glob [%s]: %s", name, pattern, err.Error())
+		}
+		rule.Globs = append(rule.Globs, glob)
+	}
+	if len(rule.Prefixes) == 0 && len(rule.Globs) == 0 {
+		return nil, fmt.Errorf("acl rule [%s] has no prefixes or globs", name)
+	}
+	return rule, nil
+}
+
+// Contains reports whether ip is in rule networks
+func (rule *ACLRule) Contains(ip net.IP) bool {
+	for _, network := range rule.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether metric has rule prefix or matches rule glob
+func (rule *ACLRule) Allows(metric []byte) bool {
+	for _, prefix := range rule.Prefixes {
+		if bytes.HasPrefix(metric, prefix) {
+			return true
+		}
+	}
+	for _, glob := range rule.Globs {
+		if glob.Match(metric) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is metric stage dropping metrics sources are not allowed to send,
+// metric is allowed if any rule covering its source allows it, sources not covered by rules are rejected
+type ACL struct {
+	sync.RWMutex
+	rules   []*ACLRule
+	sources map[string][]*ACLRule
+	// unknownRejected counts metrics of sources not covered by rules
+	unknownRejected metrics.Meter
+}
+
+// NewACL creates ACL with rules registering rejected counters of every rule
+func NewACL(rules []*ACLRule) *ACL {
+	for _, rule := range rules {
+		rule.rejected = aclRejectedMeter(rule.Name)
+	}
+	return &ACL{
+		rules:           rules,
+		sources:         make(map[string][]*ACLRule),
+		unknownRejected: aclRejectedMeter(aclUnknownSource),
+	}
+}
+
+// ProcessMetric passes metric if its source is allowed to send it and counts rejected metrics by the first rule covering source
+func (acl *ACL) ProcessMetric(metric []byte, source string) ([]byte, bool) {
+	rules := acl.sourceRules(source)
+	for _, rule := range rules {
+		if rule.Allows(metric) {
+			return metric, true
+		}
+	}
+	if len(rules) > 0 {
+		rules[0].rejected.Mark(1)
+	} else {
+		acl.unknownRejected.Mark(1)
+	}
+	MarkDropped(DropReasonACL, 1)
+	return nil, false
+}
+
+// sourceRules returns rules covering source address with optional port
+func (acl *ACL) sourceRules(source string) []*ACLRule {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+	acl.RLock()
+	rules, ok := acl.sources[host]
+	acl.RUnlock()
+	if ok {
+		return rules
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, rule := range acl.rules {
+			if rule.Contains(ip) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	acl.Lock()
+	if len(acl.sources) >= aclSourcesCacheSize {
+		acl.sources = make(map[string][]*ACLRule)
+	}
+	acl.sources[host] = rules
+	acl.Unlock()
+	return rules
+}
+
+// ACLRejectedCount returns number of metrics rejected by rule, sources not covered by rules are counted as unknown_source
+func ACLRejectedCount(rule string) int64 {
+	return aclRejectedMeter(rule).Count()
+}
+
+func aclRejectedMeter(rule string) metrics.Meter {
+	return metrics.GetOrRegisterMeter(fmt.Sprintf("acl.%s.rejected", rule), metrics.DefaultRegistry)
+}
@@ -4,11 +4,23 @@ import (
 	"bufio"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/moira-alert/cache/logging"
 )
 
 var cache *CacheStorage
 
+const (
+	defaultCacheMemoryLimit = 256 * 1024 * 1024
+	defaultCacheTTL         = time.Hour
+	defaultBatchSize        = 10
+	defaultFlushInterval    = time.Second
+	// matchedMetricSize approximates memory used by MatchedMetric struct with its patterns slice
+	matchedMetricSize = 96
+)
+
 type retentionMatcher struct {
 	pattern   *regexp.Regexp
 	retention int
@@ -16,18 +28,26 @@ type retentionMatcher struct {
 
 // CacheStorage struct to store retention matchers
 type CacheStorage struct {
+	// pending is number of buffered metrics not passed to save yet
+	pending int64
+	// BatchSize is number of buffered metrics saved at once
+	BatchSize int
+	// FlushInterval is maximum time metric stays in buffer
+	FlushInterval time.Duration
+
 	retentions      []retentionMatcher
-	retentionsCache map[string]*retentionCacheItem
-	metricsCache    map[string]*MatchedMetric
+	retentionsCache *expiringCache
+	metricsCache    *expiringCache
 }
 
 // NewCacheStorage create new CacheStorage
 func NewCacheStorage(retentionScanner *bufio.Scanner) (*CacheStorage, error) {
 
 	storage := &CacheStorage{
-		retentionsCache: make(map[string]*retentionCacheItem),
-		metricsCache:    make(map[string]*MatchedMetric),
+		BatchSize:     defaultBatchSize,
+		FlushInterval: defaultFlushInterval,
 	}
+	storage.SetCacheLimits(defaultCacheMemoryLimit, defaultCacheTTL)
 	if err := storage.buildRetentions(retentionScanner); err != nil {
 		return nil, err
 	}
@@ -35,6 +55,18 @@ func NewCacheStorage(retentionScanner *bufio.Scanner) (*CacheStorage, error) {
 	return storage, nil
 }
 
+// SetCacheLimits replaces metrics and retentions caches with empty ones
+// memoryLimit in bytes is shared evenly between both caches, ttl is lifetime of entry since last update
+func (cs *CacheStorage) SetCacheLimits(memoryLimit int64, ttl time.Duration) {
+	cs.metricsCache = newExpiringCache("metrics", memoryLimit/2, ttl)
+	cs.retentionsCache = newExpiringCache("retentions", memoryLimit/2, ttl)
+}
+
+// RetentionsCount returns number of parsed retention rules
+func (cs *CacheStorage) RetentionsCount() int {
+	return len(cs.retentions)
+}
+
 func (cs *CacheStorage) buildRetentions(retentionScanner *bufio.Scanner) error {
 	cs.retentions = make([]retentionMatcher, 0, 100)
 
@@ -65,52 +97,77 @@ func (cs *CacheStorage) buildRetentions(retentionScanner *bufio.Scanner) error {
 	return retentionScanner.Err()
 }
 
-// ProcessMatchedMetrics make buffer of metrics and save it
+// ProcessMatchedMetrics make buffer of metrics and save it, buffer is flushed when channel is closed
 func (cs *CacheStorage) ProcessMatchedMetrics(ch chan *MatchedMetric, save func(map[string]*MatchedMetric)) {
 	buffer := make(map[string]*MatchedMetric)
+	ticker := time.NewTicker(cs.FlushInterval)
+	defer ticker.Stop()
+	flush := func() {
+		if len(buffer) == 0 {
+			return
+		}
+		timer := time.Now()
+		BatchSize.Update(int64(len(buffer)))
+		save(buffer)
+		SavingTimer.UpdateSince(timer)
+		atomic.AddInt64(&cs.pending, -int64(len(buffer)))
+		buffer = make(map[string]*MatchedMetric)
+	}
 	for {
 		select {
 		case m, ok := <-ch:
 			if !ok {
+				flush()
 				return
 			}
 
+			updateSince(QueueTimer, m.QueuedAt)
+			size := len(buffer)
 			cs.EnrichMatchedMetric(buffer, m)
+			atomic.AddInt64(&cs.pending, int64(len(buffer)-size))
 
-			if len(buffer) < 10 {
+			if len(buffer) < cs.BatchSize {
 				continue
 			}
-			break
-		case <-time.After(time.Second):
-			break
-		}
-		if len(buffer) == 0 {
-			continue
+		case <-ticker.C:
 		}
-		timer := time.Now()
-		save(buffer)
-		SavingTimer.UpdateSince(timer)
-		buffer = make(map[string]*MatchedMetric)
+		flush()
 	}
 }
 
+// Pending returns number of buffered metrics not passed to save yet
+func (cs *CacheStorage) Pending() int64 {
+	return atomic.LoadInt64(&cs.pending)
+}
+
 // EnrichMatchedMetric calculate retention and filter cached values
 func (cs *CacheStorage) EnrichMatchedMetric(buffer map[string]*MatchedMetric, m *MatchedMetric) {
 	m.Retention = cs.GetRetention(m)
 	m.RetentionTimestamp = roundToNearestRetention(m.Timestamp, int64(m.Retention))
-	if ex, ok := cs.metricsCache[m.Metric]; ok && ex.RetentionTimestamp == m.RetentionTimestamp && ex.Value == m.Value {
-		return
+	if value, ok := cs.metricsCache.get(m.Metric); ok {
+		if ex := value.(*MatchedMetric); ex.RetentionTimestamp == m.RetentionTimestamp && ex.Value == m.Value {
+			return
+		}
 	}
-	cs.metricsCache[m.Metric] = m
+	cs.metricsCache.set(m.Metric, m, matchedMetricSize)
 	buffer[m.Metric] = m
 }
 
-// SavePoints saving matched metrics to DB
-func (cs *CacheStorage) SavePoints(buffer map[string]*MatchedMetric, db *DbConnector) error {
+// SavePoints saving matched metrics to storage and publishing events about them
+// failed publishing is counted and logged only, saving points again would not deliver events
+func (cs *CacheStorage) SavePoints(buffer map[string]*MatchedMetric, storage Storage) error {
 
-	if err := db.saveMetrics(buffer); err != nil {
+	if err := storage.SavePoints(buffer); err != nil {
 		return err
 	}
 
+	if err := storage.PublishEvents(buffer); err != nil {
+		FailedEvents.Mark(int64(len(buffer)))
+		logging.Errorf("failed to publish events of %d saved points: %s", len(buffer), err.Error())
+		return nil
+	}
+	for _, m := range buffer {
+		updateSince(EndToEndTimer, m.ReceivedAt)
+	}
 	return nil
 }
@@ -0,0 +1,299 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/logging"
+)
+
+const (
+	clusterSlots = 16384
+	// maxClusterRedirects limits MOVED and ASK redirects followed by single command
+	maxClusterRedirects = 5
+)
+
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// KeySlot returns redis cluster slot of key, only part inside the first {...} is hashed if it is not empty
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^key[i]]
+	}
+	return int(crc) % clusterSlots
+}
+
+// ClusterClient routes commands to redis cluster nodes by key slots
+type ClusterClient struct {
+	sync.RWMutex
+	seeds   []string
+	options *RedisOptions
+	dial    func(addr string) (redis.Conn, error)
+	pools   map[string]*redis.Pool
+	slots   [clusterSlots]string
+}
+
+// NewClusterClient creates cluster client and loads slots map from one of seed nodes
+// connections are opened by dial, nil dial opens connections with options
+func NewClusterClient(seeds []string, options *RedisOptions, dial func(addr string) (redis.Conn, error)) (*ClusterClient, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no cluster nodes configured")
+	}
+	if dial == nil {
+		dial = func(addr string) (redis.Conn, error) {
+			return DialRedis(addr, options)
+		}
+	}
+	cluster := &ClusterClient{
+		seeds:   seeds,
+		options: options,
+		dial:    dial,
+		pools:   make(map[string]*redis.Pool),
+	}
+	if err := cluster.RefreshSlots(); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// RefreshSlots reloads slots map asking known nodes until the first one answers
+func (cluster *ClusterClient) RefreshSlots() error {
+	cluster.RLock()
+	nodes := make([]string, 0, len(cluster.pools)+len(cluster.seeds))
+	for addr := range cluster.pools {
+		nodes = append(nodes, addr)
+	}
+	cluster.RUnlock()
+	nodes = append(nodes, cluster.seeds...)
+
+	var lastErr error
+	for _, addr := range nodes {
+		c := cluster.pool(addr).Get()
+		ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := cluster.setSlots(ranges); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to load cluster slots: %s", lastErr.Error())
+}
+
+// setSlots fills slots map from CLUSTER SLOTS reply: [[start, end, [ip, port, ...], replicas...], ...]
+func (cluster *ClusterClient) setSlots(ranges []interface{}) error {
+	var slots [clusterSlots]string
+	for _, item := range ranges {
+		slotRange, err := redis.Values(item, nil)
+		if err != nil || len(slotRange) < 3 {
+			return fmt.Errorf("unexpected slot range: %v", item)
+		}
+		start, err := redis.Int(slotRange[0], nil)
+		if err != nil {
+			return err
+		}
+		end, err := redis.Int(slotRange[1], nil)
+		if err != nil {
+			return err
+		}
+		master, err := redis.Values(slotRange[2], nil)
+		if err != nil || len(master) < 2 {
+			return fmt.Errorf("unexpected slot master: %v", slotRange[2])
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return err
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = addr
+		}
+	}
+	cluster.Lock()
+	cluster.slots = slots
+	cluster.Unlock()
+	return nil
+}
+
+func (cluster *ClusterClient) pool(addr string) *redis.Pool {
+	cluster.RLock()
+	pool, ok := cluster.pools[addr]
+	cluster.RUnlock()
+	if ok {
+		return pool
+	}
+	cluster.Lock()
+	defer cluster.Unlock()
+	if pool, ok = cluster.pools[addr]; ok {
+		return pool
+	}
+	pool = newPool(cluster.options, func() (redis.Conn, error) {
+		return cluster.dial(addr)
+	})
+	cluster.pools[addr] = pool
+	return pool
+}
+
+// node returns address of node serving key
+func (cluster *ClusterClient) node(key interface{}) string {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	addr := cluster.slots[KeySlot(fmt.Sprint(key))]
+	if addr == "" {
+		return cluster.seeds[0]
+	}
+	return addr
+}
+
+func (cluster *ClusterClient) moved(slot int, addr string) {
+	cluster.Lock()
+	cluster.slots[slot] = addr
+	cluster.Unlock()
+}
+
+// Do runs single command on node serving its first argument following cluster redirects
+func (cluster *ClusterClient) Do(commandName string, args ...interface{}) (interface{}, error) {
+	addr := cluster.node(args[0])
+	asking := false
+	for i := 0; ; i++ {
+		c := cluster.pool(addr).Get()
+		if asking {
+			c.Send("ASKING")
+		}
+		reply, err := c.Do(commandName, args...)
+		c.Close()
+		redirect, ok := parseRedirect(err)
+		if !ok || i >= maxClusterRedirects {
+			return reply, err
+		}
+		if !redirect.ask {
+			cluster.moved(redirect.slot, redirect.addr)
+		}
+		addr, asking = redirect.addr, redirect.ask
+	}
+}
+
+// pipeline groups commands by nodes and runs groups concurrently following MOVED and ASK redirects
+func (cluster *ClusterClient) pipeline(commands []*redisCommand) ([]*redisCommand, error) {
+	var (
+		failed  []*redisCommand
+		lastErr error
+	)
+	for redirects := 0; len(commands) > 0; redirects++ {
+		groups := make(map[string][]*redisCommand)
+		asking := make(map[string][]*redisCommand)
+		for _, command := range commands {
+			if command.asking != "" {
+				asking[command.asking] = append(asking[command.asking], command)
+			} else {
+				addr := cluster.node(command.key())
+				groups[addr] = append(groups[addr], command)
+			}
+		}
+
+		var (
+			lock       sync.Mutex
+			wg         sync.WaitGroup
+			redirected []*redisCommand
+			refresh    bool
+		)
+		run := func(addr string, group []*redisCommand, ask bool) {
+			defer wg.Done()
+			c := cluster.pool(addr).Get()
+			defer c.Close()
+			groupFailed, err := pipelineOn(c, group, ask)
+			lock.Lock()
+			defer lock.Unlock()
+			for _, command := range groupFailed {
+				redirect, ok := parseRedirect(command.err)
+				if !ok || redirects >= maxClusterRedirects {
+					failed = append(failed, command)
+					lastErr = err
+					continue
+				}
+				retry := *command
+				retry.asking = ""
+				if redirect.ask {
+					retry.asking = redirect.addr
+				} else {
+					cluster.moved(redirect.slot, redirect.addr)
+					refresh = true
+				}
+				redirected = append(redirected, &retry)
+			}
+		}
+		for addr, group := range groups {
+			wg.Add(1)
+			go run(addr, group, false)
+		}
+		for addr, group := range asking {
+			wg.Add(1)
+			go run(addr, group, true)
+		}
+		wg.Wait()
+
+		if refresh {
+			if err := cluster.RefreshSlots(); err != nil {
+				logging.Errorf("cluster slots refresh failed: %s", err.Error())
+			}
+		}
+		commands = redirected
+	}
+	return failed, lastErr
+}
+
+type clusterRedirect struct {
+	ask  bool
+	slot int
+	addr string
+}
+
+// parseRedirect parses "MOVED <slot> <addr>" and "ASK <slot> <addr>" errors
+func parseRedirect(err error) (*clusterRedirect, bool) {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return nil, false
+	}
+	parts := strings.Split(string(redisErr), " ")
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return nil, false
+	}
+	slot, convErr := strconv.Atoi(parts[1])
+	if convErr != nil {
+		return nil, false
+	}
+	return &clusterRedirect{ask: parts[0] == "ASK", slot: slot, addr: parts[2]}, true
+}
@@ -2,19 +2,69 @@ package filter
 
 import (
 	"fmt"
-	"time"
 	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/logging"
+	"github.com/vova616/xxhash"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxRetries      = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultMaxRetryBackoff = 5 * time.Second
+	defaultTrimSampling    = 10
 )
 
 // DbConnector is DB layer client
 type DbConnector struct {
-	Pool  *redis.Pool
+	// lastWrite is unix time in nanoseconds of the last successfully executed commands,
+	// it is the first field to be 64-bit aligned for atomic operations
+	lastWrite int64
+
+	Pool *redis.Pool
+	// Cluster routes commands to redis cluster nodes instead of Pool if set
+	Cluster *ClusterClient
+	// MaxRetries is number of retries of commands failed with transient errors
+	MaxRetries int
+	// RetryBackoff is delay before the first retry, it doubles on every next one
+	RetryBackoff time.Duration
+	// MaxRetryBackoff limits delay between retries
+	MaxRetryBackoff time.Duration
+	// MetricsTTL is number of seconds metric points are kept for, older ones are trimmed
+	MetricsTTL int64
+	// KeyTTL is number of seconds metric keys expire after the last saved point
+	KeyTTL int64
+	// TrimSampling makes points trimmed on every n-th retention interval of each metric only
+	TrimSampling int
+	// EventsVersion is schema of published metric events, EventsVersionBatch publishes one event per flush
+	EventsVersion int
+	// EventsTransport selects pub/sub channel, stream or both for metric events
+	EventsTransport EventsTransport
+	// EventsStream is redis stream events are appended to
+	EventsStream string
+	// EventsStreamMaxLen is approximate number of events kept in stream
+	EventsStreamMaxLen int64
+	// EventsPayload selects metric point fields sent in events
+	EventsPayload EventsPayload
+	// EventsEncoding selects JSON or compact binary events
+	EventsEncoding EventsEncoding
+	// SelfStateTTL is number of seconds instance state is kept after the last heartbeat
+	SelfStateTTL int64
 }
 
 // NewDbConnector return db connector
 func NewDbConnector(pool *redis.Pool) *DbConnector {
 	return &DbConnector{
-		Pool:  pool,
+		Pool:               pool,
+		MaxRetries:         defaultMaxRetries,
+		RetryBackoff:       defaultRetryBackoff,
+		MaxRetryBackoff:    defaultMaxRetryBackoff,
+		TrimSampling:       defaultTrimSampling,
+		EventsVersion:      EventsVersionSingle,
+		EventsStream:       DefaultEventsStream,
+		EventsStreamMaxLen: DefaultEventsStreamMaxLen,
+		SelfStateTTL:       DefaultSelfStateTTL,
 	}
 }
 
@@ -28,25 +78,31 @@ func GetMetricRetentionDbKey(metric string) string {
 	return fmt.Sprintf("moira-metric-retention:%s", metric)
 }
 
-// UpdateMetricsHeartbeat increments redis counter
+// UpdateMetricsHeartbeat increments redis counter shared by all cache instances
 func (connector *DbConnector) UpdateMetricsHeartbeat() error {
-	c := connector.Pool.Get()
-	defer c.Close()
-	err := c.Send("INCR", "moira-selfstate:metrics-heartbeat")
+	_, err := connector.do("INCR", metricsHeartbeatDbKey)
 	return err
 }
 
-func (connector *DbConnector) getPatterns() ([]string, error) {
-	c := connector.Pool.Get()
-	defer c.Close()
-	return redis.Strings(c.Do("SMEMBERS", "moira-pattern-list"))
+// GetPatterns returns patterns list
+func (connector *DbConnector) GetPatterns() ([]string, error) {
+	return redis.Strings(connector.do("SMEMBERS", "moira-pattern-list"))
 }
 
-func (connector *DbConnector) saveMetrics(buffer map[string]*MatchedMetric) error {
-
+// do runs single command on redis or cluster node serving its key
+func (connector *DbConnector) do(commandName string, args ...interface{}) (interface{}, error) {
+	if connector.Cluster != nil {
+		return connector.Cluster.Do(commandName, args...)
+	}
 	c := connector.Pool.Get()
 	defer c.Close()
+	return c.Do(commandName, args...)
+}
 
+// SavePoints saves metric points and retentions
+func (connector *DbConnector) SavePoints(buffer map[string]*MatchedMetric) error {
+
+	commands := make([]*redisCommand, 0, len(buffer)*2)
 	for _, m := range buffer {
 
 		metricKey := GetMetricDbKey(m.Metric)
@@ -54,38 +110,113 @@ func (connector *DbConnector) saveMetrics(buffer map[string]*MatchedMetric) erro
 
 		metricValue := fmt.Sprintf("%v %v", m.Timestamp, m.Value)
 
-		c.Send("ZADD", metricKey, m.RetentionTimestamp, metricValue)
-		c.Send("SET", metricRetentionKey, m.Retention)
+		if connector.MetricsTTL > 0 || connector.KeyTTL > 0 {
+			trimBefore := ""
+			if connector.MetricsTTL > 0 && connector.shouldTrim(m) {
+				trimBefore = fmt.Sprint(m.RetentionTimestamp - connector.MetricsTTL)
+			}
+			commands = append(commands, saveMetricScript.command([]interface{}{metricKey}, m.RetentionTimestamp, metricValue, trimBefore, connector.KeyTTL))
+		} else {
+			commands = append(commands, newRedisCommand("ZADD", metricKey, m.RetentionTimestamp, metricValue))
+		}
+		if connector.KeyTTL > 0 {
+			commands = append(commands, newRedisCommand("SET", metricRetentionKey, m.Retention, "EX", connector.KeyTTL))
+		} else {
+			commands = append(commands, newRedisCommand("SET", metricRetentionKey, m.Retention))
+		}
+	}
+	return connector.execute(commands)
+}
 
+// PublishEvents publishes metric event for every pattern metric is matched by
+// to events channel, events stream or both of them
+// batched events go to metric-events-v2 channel and are marked with version field in stream
+func (connector *DbConnector) PublishEvents(buffer map[string]*MatchedMetric) error {
+	events, err := connector.makeEvents(buffer)
+	if err != nil {
+		return err
+	}
+	channel := metricEventChannel
+	if connector.EventsVersion == EventsVersionBatch {
+		channel = metricEventsBatchChannel
+	}
+	commands := make([]*redisCommand, 0, len(events))
+	for _, event := range events {
+		if connector.EventsTransport != EventsTransportStream {
+			commands = append(commands, newRedisCommand("PUBLISH", channel, event))
+		}
+		if connector.EventsTransport != EventsTransportPubSub {
+			commands = append(commands, newRedisCommand("XADD", connector.EventsStream, "MAXLEN", "~", connector.EventsStreamMaxLen, "*",
+				"event", event, "version", connector.EventsVersion))
+		}
+	}
+	return connector.execute(commands)
+}
+
+func (connector *DbConnector) makeEvents(buffer map[string]*MatchedMetric) ([][]byte, error) {
+	format := eventsFormat{payload: connector.EventsPayload, encoding: connector.EventsEncoding}
+	if connector.EventsVersion == EventsVersionBatch {
+		event, ok, err := makeEventsBatch(buffer, format)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return [][]byte{event}, nil
+	}
+	events := make([][]byte, 0, len(buffer))
+	for _, m := range buffer {
 		for _, pattern := range m.Patterns {
-			event, err := makeEvent(pattern, m.Metric)
+			event, err := makeEvent(pattern, m, format)
 			if err != nil {
+				FailedEvents.Mark(1)
+				logging.Errorf("failed to make event of %s matched by %s: %s", m.Metric, pattern, err.Error())
 				continue
 			}
-			c.Send("PUBLISH", "metric-event", event)
+			events = append(events, event)
 		}
 	}
-	return c.Flush()
+	return events, nil
+}
+
+// shouldTrim spreads trimming of metrics between retention intervals by metric name hash
+func (connector *DbConnector) shouldTrim(m *MatchedMetric) bool {
+	if connector.TrimSampling <= 1 || m.Retention <= 0 {
+		return true
+	}
+	interval := uint64(m.RetentionTimestamp / int64(m.Retention))
+	return (interval+uint64(xxhash.Checksum32([]byte(m.Metric))))%uint64(connector.TrimSampling) == 0
 }
 
 // NewRedisPool return redis.Pool from host:port URI
 func NewRedisPool(redisURI string, dbID ...int) *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:     10,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", redisURI)
-			if err != nil {
-				return nil, err
-			}
-			if len(dbID) > 0 {
-				c.Do("SELECT", dbID[0])
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+	options := &RedisOptions{}
+	if len(dbID) > 0 {
+		options.DbID = dbID[0]
 	}
+	return NewRedisPoolWithOptions(redisURI, options)
+}
+
+// NewRedisPoolWithOptions return redis.Pool from host:port URI and connection options
+func NewRedisPoolWithOptions(redisURI string, options *RedisOptions) *redis.Pool {
+	return newPool(options, func() (redis.Conn, error) {
+		return DialRedis(redisURI, options)
+	})
+}
+
+// LastWrite returns time of the last successful write to redis
+func (connector *DbConnector) LastWrite() time.Time {
+	if lastWrite := atomic.LoadInt64(&connector.lastWrite); lastWrite != 0 {
+		return time.Unix(0, lastWrite)
+	}
+	return time.Time{}
+}
+
+// Ping checks that redis is reachable with configured credentials and database
+func (connector *DbConnector) Ping() error {
+	if connector.Cluster != nil {
+		return connector.Cluster.RefreshSlots()
+	}
+	c := connector.Pool.Get()
+	defer c.Close()
+	_, err := c.Do("PING")
+	return err
 }
@@ -0,0 +1,175 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// binaryEventsExtended flag marks binary events carrying metric points
+const binaryEventsExtended = 1
+
+var errShortBinaryEvents = errors.New("unexpected end of binary events")
+
+// encodeBinaryEvents serializes events grouped by patterns to compact binary format:
+//
+//	message := version:byte flags:byte groups:uvarint group...
+//	group   := pattern:string metrics:uvarint (metric:string point?)...
+//	point   := value:float64 timestamp:varint retention_timestamp:varint retention:uvarint tags:uvarint (key:string value:string)...
+//	string  := length:uvarint bytes
+//
+// float64 is 8 bytes big endian, point is present if flags has binaryEventsExtended bit set.
+// The first byte is event version, so it never clashes with '{' of JSON events
+func encodeBinaryEvents(version int, extended bool, groups []patternEvents) []byte {
+	flags := byte(0)
+	if extended {
+		flags |= binaryEventsExtended
+	}
+	buf := make([]byte, 0, 64)
+	buf = append(buf, byte(version), flags)
+	buf = appendUvarint(buf, uint64(len(groups)))
+	for _, group := range groups {
+		buf = appendString(buf, group.Pattern)
+		buf = appendUvarint(buf, uint64(len(group.Metrics)))
+		for i, metric := range group.Metrics {
+			buf = appendString(buf, metric)
+			if extended {
+				buf = appendEventPoint(buf, group.points[i])
+			}
+		}
+	}
+	return buf
+}
+
+func appendEventPoint(buf []byte, point *EventPoint) []byte {
+	var value [8]byte
+	binary.BigEndian.PutUint64(value[:], math.Float64bits(float64(point.Value)))
+	buf = append(buf, value[:]...)
+	buf = appendVarint(buf, point.Timestamp)
+	buf = appendVarint(buf, point.RetentionTimestamp)
+	buf = appendUvarint(buf, uint64(point.Retention))
+	keys := make([]string, 0, len(point.Tags))
+	for key := range point.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		buf = appendString(buf, key)
+		buf = appendString(buf, point.Tags[key])
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], value)]...)
+}
+
+func appendVarint(buf []byte, value int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], value)]...)
+}
+
+func appendString(buf []byte, value string) []byte {
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// DecodeBinaryEvents parses event serialized by binary events encoding and returns its version and events
+func DecodeBinaryEvents(data []byte) (int, []MetricEvent, error) {
+	if len(data) < 2 {
+		return 0, nil, errShortBinaryEvents
+	}
+	version, flags := int(data[0]), data[1]
+	if version != EventsVersionSingle && version != EventsVersionBatch {
+		return 0, nil, fmt.Errorf("unsupported binary events version %d", version)
+	}
+	decoder := &binaryDecoder{data: data[2:]}
+	var events []MetricEvent
+	groups := decoder.uvarint()
+	for i := uint64(0); i < groups && decoder.err == nil; i++ {
+		pattern := decoder.string()
+		metrics := decoder.uvarint()
+		for j := uint64(0); j < metrics && decoder.err == nil; j++ {
+			event := MetricEvent{Metric: decoder.string(), Pattern: pattern}
+			if flags&binaryEventsExtended != 0 {
+				event.Point = decoder.eventPoint()
+			}
+			events = append(events, event)
+		}
+	}
+	if decoder.err != nil {
+		return 0, nil, decoder.err
+	}
+	return version, events, nil
+}
+
+// binaryDecoder reads values written by append functions keeping the first error
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (decoder *binaryDecoder) uvarint() uint64 {
+	if decoder.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(decoder.data)
+	if n <= 0 {
+		decoder.err = errShortBinaryEvents
+		return 0
+	}
+	decoder.data = decoder.data[n:]
+	return value
+}
+
+func (decoder *binaryDecoder) varint() int64 {
+	if decoder.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(decoder.data)
+	if n <= 0 {
+		decoder.err = errShortBinaryEvents
+		return 0
+	}
+	decoder.data = decoder.data[n:]
+	return value
+}
+
+func (decoder *binaryDecoder) bytes(length uint64) []byte {
+	if decoder.err != nil {
+		return nil
+	}
+	if uint64(len(decoder.data)) < length {
+		decoder.err = errShortBinaryEvents
+		return nil
+	}
+	value := decoder.data[:length]
+	decoder.data = decoder.data[length:]
+	return value
+}
+
+func (decoder *binaryDecoder) string() string {
+	return string(decoder.bytes(decoder.uvarint()))
+}
+
+func (decoder *binaryDecoder) eventPoint() *EventPoint {
+	point := &EventPoint{}
+	if value := decoder.bytes(8); value != nil {
+		point.Value = JSONFloat(math.Float64frombits(binary.BigEndian.Uint64(value)))
+	}
+	point.Timestamp = decoder.varint()
+	point.RetentionTimestamp = decoder.varint()
+	point.Retention = int(decoder.uvarint())
+	if tags := decoder.uvarint(); tags > 0 {
+		point.Tags = make(map[string]string)
+		for i := uint64(0); i < tags && decoder.err == nil; i++ {
+			key := decoder.string()
+			point.Tags[key] = decoder.string()
+		}
+	}
+	return point
+}
@@ -2,19 +2,218 @@ package filter
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 )
 
+const (
+	metricEventChannel = "metric-event"
+	// metricEventsBatchChannel carries batched events so checkers subscribed to metric-event never get them
+	metricEventsBatchChannel = "metric-events-v2"
+	// EventsVersionSingle publishes event per metric and pattern pair
+	EventsVersionSingle = 1
+	// EventsVersionBatch publishes one event per flush with metrics grouped by patterns
+	EventsVersionBatch = 2
+	// DefaultEventsStream is redis stream events are appended to
+	DefaultEventsStream = "moira-metric-events"
+	// DefaultEventsStreamMaxLen is approximate number of events kept in stream
+	DefaultEventsStreamMaxLen = 1000000
+)
+
+// EventsTransport defines how metric events are delivered to checkers
+type EventsTransport int
+
+const (
+	// EventsTransportPubSub publishes events to metric-event channel
+	EventsTransportPubSub EventsTransport = iota
+	// EventsTransportStream appends events to capped redis stream
+	EventsTransportStream
+	// EventsTransportBoth publishes events to channel and appends them to stream
+	EventsTransportBoth
+)
+
+// ParseEventsTransport parses events transport name from config
+func ParseEventsTransport(name string) (EventsTransport, error) {
+	switch name {
+	case "", "pubsub":
+		return EventsTransportPubSub, nil
+	case "stream":
+		return EventsTransportStream, nil
+	case "both":
+		return EventsTransportBoth, nil
+	}
+	return EventsTransportPubSub, fmt.Errorf("unknown events transport [%s]", name)
+}
+
+// EventsPayload defines which metric point fields are sent in events
+type EventsPayload int
+
+const (
+	// EventsPayloadBasic sends metric and pattern only
+	EventsPayloadBasic EventsPayload = iota
+	// EventsPayloadExtended adds value, timestamps, retention and tags of point
+	EventsPayloadExtended
+)
+
+// ParseEventsPayload parses events payload name from config
+func ParseEventsPayload(name string) (EventsPayload, error) {
+	switch name {
+	case "", "basic":
+		return EventsPayloadBasic, nil
+	case "extended":
+		return EventsPayloadExtended, nil
+	}
+	return EventsPayloadBasic, fmt.Errorf("unknown events payload [%s]", name)
+}
+
+// EventsEncoding defines how events are serialized
+type EventsEncoding int
+
+const (
+	// EventsEncodingJSON serializes events to JSON
+	EventsEncodingJSON EventsEncoding = iota
+	// EventsEncodingBinary serializes events to compact binary format, see encodeBinaryEvents
+	EventsEncodingBinary
+)
+
+// ParseEventsEncoding parses events encoding name from config
+func ParseEventsEncoding(name string) (EventsEncoding, error) {
+	switch name {
+	case "", "json":
+		return EventsEncodingJSON, nil
+	case "binary":
+		return EventsEncodingBinary, nil
+	}
+	return EventsEncodingJSON, fmt.Errorf("unknown events encoding [%s]", name)
+}
+
+// eventsFormat is combination of events options used to serialize events
+type eventsFormat struct {
+	payload  EventsPayload
+	encoding EventsEncoding
+}
+
+// EventPoint is point of metric sent in extended events payload, non-finite values are sent as strings
+type EventPoint struct {
+	Value              JSONFloat         `json:"value"`
+	Timestamp          int64             `json:"timestamp"`
+	RetentionTimestamp int64             `json:"retention_timestamp"`
+	Retention          int               `json:"retention"`
+	Tags               map[string]string `json:"tags,omitempty"`
+}
+
+func newEventPoint(m *MatchedMetric, format eventsFormat) *EventPoint {
+	if format.payload != EventsPayloadExtended {
+		return nil
+	}
+	return &EventPoint{
+		Value:              JSONFloat(m.Value),
+		Timestamp:          m.Timestamp,
+		RetentionTimestamp: m.RetentionTimestamp,
+		Retention:          m.Retention,
+		Tags:               parseTags(m.Metric),
+	}
+}
+
+// parseTags parses graphite tags of metric name in "name;tag1=value1;tag2=value2" format
+func parseTags(metric string) map[string]string {
+	parts := strings.Split(metric, ";")
+	if len(parts) == 1 {
+		return nil
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		if i := strings.IndexByte(part, '='); i > 0 {
+			tags[part[:i]] = part[i+1:]
+		}
+	}
+	return tags
+}
+
 type eventMessage struct {
 	Metric  string `json:"metric"`
 	Pattern string `json:"pattern"`
+	*EventPoint
 }
 
-func makeEvent(pattern string, metric string) ([]byte, error) {
+func makeEvent(pattern string, m *MatchedMetric, format eventsFormat) ([]byte, error) {
+	point := newEventPoint(m, format)
+	if format.encoding == EventsEncodingBinary {
+		return encodeBinaryEvents(EventsVersionSingle, point != nil, []patternEvents{{
+			Pattern: pattern,
+			Metrics: []string{m.Metric},
+			points:  []*EventPoint{point},
+		}}), nil
+	}
 
 	event := &eventMessage{
-		Metric:  metric,
-		Pattern: pattern,
+		Metric:     m.Metric,
+		Pattern:    pattern,
+		EventPoint: point,
 	}
 
 	return json.Marshal(event)
 }
+
+type patternEvents struct {
+	Pattern string   `json:"pattern"`
+	Metrics []string `json:"metrics"`
+	// Points are extended payloads of metrics by their names
+	Points map[string]*EventPoint `json:"points,omitempty"`
+	// points are extended payloads in the same order as Metrics for binary encoding
+	points []*EventPoint
+}
+
+type eventsBatch struct {
+	Version int             `json:"version"`
+	Events  []patternEvents `json:"events"`
+}
+
+// makeEventsBatch groups buffered metrics by patterns without duplicates
+func makeEventsBatch(buffer map[string]*MatchedMetric, format eventsFormat) ([]byte, bool, error) {
+	metrics := make(map[string]map[string]*MatchedMetric)
+	for _, m := range buffer {
+		for _, pattern := range m.Patterns {
+			if metrics[pattern] == nil {
+				metrics[pattern] = make(map[string]*MatchedMetric)
+			}
+			metrics[pattern][m.Metric] = m
+		}
+	}
+	if len(metrics) == 0 {
+		return nil, false, nil
+	}
+
+	patterns := make([]string, 0, len(metrics))
+	for pattern := range metrics {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	batch := &eventsBatch{
+		Version: EventsVersionBatch,
+		Events:  make([]patternEvents, 0, len(patterns)),
+	}
+	for _, pattern := range patterns {
+		events := patternEvents{Pattern: pattern, Metrics: make([]string, 0, len(metrics[pattern]))}
+		for metric := range metrics[pattern] {
+			events.Metrics = append(events.Metrics, metric)
+		}
+		sort.Strings(events.Metrics)
+		if format.payload == EventsPayloadExtended {
+			events.Points = make(map[string]*EventPoint, len(events.Metrics))
+			events.points = make([]*EventPoint, 0, len(events.Metrics))
+			for _, metric := range events.Metrics {
+				point := newEventPoint(metrics[pattern][metric], format)
+				events.Points[metric] = point
+				events.points = append(events.points, point)
+			}
+		}
+		batch.Events = append(batch.Events, events)
+	}
+	if format.encoding == EventsEncodingBinary {
+		return encodeBinaryEvents(EventsVersionBatch, format.payload == EventsPayloadExtended, batch.Events), true, nil
+	}
+	event, err := json.Marshal(batch)
+	return event, true, err
+}
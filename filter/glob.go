@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"bytes"
+	"path"
+	"strings"
+)
+
+// Glob is graphite metric name pattern with *, ?, [...] and {a,b} in dot-separated parts
+type Glob struct {
+	Pattern string
+	// parts keep alternatives of every name part, literal alternatives are matched without path.Match
+	parts [][]string
+}
+
+// CompileGlob parses graphite metric name pattern
+func CompileGlob(pattern string) (*Glob, error) {
+	glob := &Glob{Pattern: pattern}
+	for _, part := range strings.Split(pattern, ".") {
+		alternatives := []string{part}
+		if strings.Contains(part, "{") && strings.Contains(part, "}") {
+			prefix, bigSuffix := split2(part, "{")
+			inner, suffix := split2(bigSuffix, "}")
+			alternatives = alternatives[:0]
+			for _, innerPart := range strings.Split(inner, ",") {
+				alternatives = append(alternatives, prefix+innerPart+suffix)
+			}
+		}
+		for _, alternative := range alternatives {
+			if _, err := path.Match(alternative, ""); err != nil {
+				return nil, err
+			}
+		}
+		glob.parts = append(glob.parts, alternatives)
+	}
+	return glob, nil
+}
+
+// Match reports whether whole metric name matches pattern
+func (glob *Glob) Match(metric []byte) bool {
+	index := 0
+	for i, alternatives := range glob.parts {
+		end := len(metric)
+		if i < len(glob.parts)-1 {
+			next := bytes.IndexByte(metric[index:], '.')
+			if next < 0 {
+				return false
+			}
+			end = index + next
+		} else if bytes.IndexByte(metric[index:], '.') >= 0 {
+			return false
+		}
+		if !matchPart(alternatives, string(metric[index:end])) {
+			return false
+		}
+		index = end + 1
+	}
+	return true
+}
+
+func matchPart(alternatives []string, part string) bool {
+	for _, alternative := range alternatives {
+		if !strings.ContainsAny(alternative, "*?[\\") {
+			if alternative == part {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(alternative, part); matched {
+			return true
+		}
+	}
+	return false
+}
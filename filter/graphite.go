@@ -1,10 +1,22 @@
 package filter
 
 import (
+	"fmt"
 	"sync/atomic"
+	"time"
+
 	"github.com/rcrowley/go-metrics"
 )
 
+const (
+	// DropReasonOverflowOldest is reason of metric dropped to free room in full shard buffer
+	DropReasonOverflowOldest = "overflow_oldest"
+	// DropReasonOverflowNewest is reason of metric dropped because shard buffer is full
+	DropReasonOverflowNewest = "overflow_newest"
+	// DropReasonLineTooLong is reason of line dropped because it is longer than connection limits allow
+	DropReasonLineTooLong = "line_too_long"
+)
+
 var (
 	// TotalMetricsReceived metrics counter
 	TotalMetricsReceived    metrics.Meter
@@ -12,23 +24,83 @@ var (
 	ValidMetricsReceived    metrics.Meter
 	// MatchingMetricsReceived metrics counter
 	MatchingMetricsReceived metrics.Meter
-	// MatchingTimer metrics timer
+	// ParsingTimer metrics timer of parsing received lines
+	ParsingTimer            metrics.Timer
+	// MatchingTimer metrics timer of matching parsed metrics against patterns
 	MatchingTimer           metrics.Timer
+	// StagesTimer metrics timer of parsed metrics passing rewrite, acl and filter stages
+	StagesTimer             metrics.Timer
+	// QueueTimer metrics timer of matched metric waiting in save shard queue
+	QueueTimer              metrics.Timer
+	// BatchSize metrics histogram of saved batch sizes
+	BatchSize               metrics.Histogram
+	// RedisTimer metrics timer of redis pipeline round trip
+	RedisTimer              metrics.Timer
+	// EndToEndTimer metrics timer from metric receipt to its event publishing
+	EndToEndTimer           metrics.Timer
 	// SavingTimer metrics timer
 	SavingTimer             metrics.Timer
 	// BuildTreeTimer metrics timer
 	BuildTreeTimer          metrics.Timer
+	// BlockedMetrics metrics counter of sends blocked by full shard buffer
+	BlockedMetrics          metrics.Meter
+	// ThrottledLines metrics counter of lines delayed by line rate limits
+	ThrottledLines          metrics.Meter
+	// RejectedConnections metrics counter of connections closed by connections limit
+	RejectedConnections     metrics.Meter
+	// IdleConnections metrics counter of connections closed by idle timeout
+	IdleConnections         metrics.Meter
+	// ActiveConnections metrics gauge of open connections
+	ActiveConnections       metrics.Gauge
+	// FailedEvents metrics counter of saved points events were not published about
+	FailedEvents            metrics.Meter
+	// TimingSampleRate is how often lines are timed by ParsingTimer, StagesTimer and MatchingTimer, every line is timed if it is 1
+	TimingSampleRate int64 = 1
+
+	// droppedMeters are meters of fixed drop reasons registered once by InitGraphiteMetrics
+	droppedMeters = map[string]metrics.Meter{}
 )
 
+// dropReasons are fixed reasons metrics are dropped for
+var dropReasons = []string{
+	DropReasonOverflowOldest,
+	DropReasonOverflowNewest,
+	DropReasonLineTooLong,
+	DropReasonSpoolOverflow,
+	DropReasonSpoolExpired,
+	DropReasonSpoolCorrupted,
+	DropReasonACL,
+	DropReasonFilter,
+	DropReasonNewNames,
+}
+
 // InitGraphiteMetrics initialize graphite metrics
 func InitGraphiteMetrics() {
 	TotalMetricsReceived = metrics.NewRegisteredMeter("received.total", metrics.DefaultRegistry)
 	ValidMetricsReceived = metrics.NewRegisteredMeter("received.valid", metrics.DefaultRegistry)
 	MatchingMetricsReceived = metrics.NewRegisteredMeter("received.matching", metrics.DefaultRegistry)
+	ParsingTimer = metrics.NewRegisteredTimer("time.parse", metrics.DefaultRegistry)
 	MatchingTimer = metrics.NewRegisteredTimer("time.match", metrics.DefaultRegistry)
+	StagesTimer = metrics.NewRegisteredTimer("time.stages", metrics.DefaultRegistry)
+	QueueTimer = metrics.NewRegisteredTimer("time.queue", metrics.DefaultRegistry)
+	BatchSize = metrics.NewRegisteredHistogram("batch.size", metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015))
+	RedisTimer = metrics.NewRegisteredTimer("time.redis", metrics.DefaultRegistry)
+	EndToEndTimer = metrics.NewRegisteredTimer("time.endtoend", metrics.DefaultRegistry)
 	SavingTimer = metrics.NewRegisteredTimer("time.save", metrics.DefaultRegistry)
 	BuildTreeTimer = metrics.NewRegisteredTimer("time.buildtree", metrics.DefaultRegistry)
+	BlockedMetrics = metrics.NewRegisteredMeter("overflow.blocked", metrics.DefaultRegistry)
+	ThrottledLines = metrics.NewRegisteredMeter("limits.throttled", metrics.DefaultRegistry)
+	RejectedConnections = metrics.NewRegisteredMeter("connections.rejected", metrics.DefaultRegistry)
+	IdleConnections = metrics.NewRegisteredMeter("connections.idle_closed", metrics.DefaultRegistry)
+	ActiveConnections = metrics.NewRegisteredGauge("connections.active", metrics.DefaultRegistry)
+	FailedEvents = metrics.NewRegisteredMeter("events.failed", metrics.DefaultRegistry)
+	meters := make(map[string]metrics.Meter, len(dropReasons))
+	for _, reason := range dropReasons {
+		meters[reason] = droppedMeter(reason)
+	}
+	droppedMeters = meters
 	totalReceived = 0
+	atomic.StoreInt64(&timedLines, 0)
 	validReceived = 0
 	matchedReceived = 0
 }
@@ -39,3 +111,31 @@ func UpdateProcessingMetrics() {
 	ValidMetricsReceived.Mark(atomic.SwapInt64(&validReceived, int64(0)))
 	MatchingMetricsReceived.Mark(atomic.SwapInt64(&matchedReceived, int64(0)))
 }
+
+// updateSince updates timer with duration since start unless start is unknown
+func updateSince(timer metrics.Timer, start time.Time) {
+	if !start.IsZero() {
+		timer.UpdateSince(start)
+	}
+}
+
+// MarkDropped counts metrics dropped for given reason
+func MarkDropped(reason string, count int64) {
+	if meter, ok := droppedMeters[reason]; ok {
+		meter.Mark(count)
+		return
+	}
+	droppedMeter(reason).Mark(count)
+}
+
+// DroppedCount returns total number of metrics dropped for given reason
+func DroppedCount(reason string) int64 {
+	if meter, ok := droppedMeters[reason]; ok {
+		return meter.Count()
+	}
+	return droppedMeter(reason).Count()
+}
+
+func droppedMeter(reason string) metrics.Meter {
+	return metrics.GetOrRegisterMeter(fmt.Sprintf("dropped.%s", reason), metrics.DefaultRegistry)
+}
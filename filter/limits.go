@@ -0,0 +1,249 @@
+package filter
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sourceStatsTTL is time statistics of disconnected source are kept for
+const sourceStatsTTL = 10 * time.Minute
+
+// sourcesExpireInterval is how often statistics of disconnected sources are expired
+const sourcesExpireInterval = time.Minute
+
+// ErrTooManyConnections is returned when connection limit is reached
+var ErrTooManyConnections = errors.New("too many connections")
+
+// ConnectionLimits are limits of incoming connections, zero value of any limit disables it
+type ConnectionLimits struct {
+	// MaxConnections is maximum number of open connections
+	MaxConnections int
+	// IPLineRate is lines per second accepted from single IP address over all its connections
+	IPLineRate float64
+	// ConnectionLineRate is lines per second accepted from single connection
+	ConnectionLineRate float64
+	// MaxLineLength is length of the longest accepted line without new line
+	MaxLineLength int
+	// IdleTimeout is time connection is closed after if nothing is received
+	IdleTimeout time.Duration
+}
+
+// TokenBucket limits rate of events allowing bursts up to bucket size
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates full bucket refilled with rate tokens per second, bucket size is one second of rate but at least one token
+func NewTokenBucket(rate float64) *TokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// Reserve takes token and returns time caller must wait for until token is available
+func (b *TokenBucket) Reserve(now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Allow takes token if it is available now
+func (b *TokenBucket) Allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// SourceStats are counters of lines received from single IP address
+type SourceStats struct {
+	Source      string    `json:"source"`
+	Connections int64     `json:"connections"`
+	Lines       int64     `json:"lines"`
+	Throttled   int64     `json:"throttled"`
+	Dropped     int64     `json:"dropped"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type sourceState struct {
+	connections int64
+	lines       int64
+	throttled   int64
+	dropped     int64
+	lastSeen    int64
+	bucket      *TokenBucket
+}
+
+// ConnectionLimiter enforces ConnectionLimits and keeps statistics of sources
+type ConnectionLimiter struct {
+	sync.Mutex
+	Limits ConnectionLimits
+
+	connections int
+	sources     map[string]*sourceState
+}
+
+// NewConnectionLimiter creates limiter with given limits
+func NewConnectionLimiter(limits ConnectionLimits) *ConnectionLimiter {
+	return &ConnectionLimiter{
+		Limits:  limits,
+		sources: make(map[string]*sourceState),
+	}
+}
+
+// Open registers new connection from IP address source or returns ErrTooManyConnections
+func (l *ConnectionLimiter) Open(source string) (*LimitedConnection, error) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.Limits.MaxConnections > 0 && l.connections >= l.Limits.MaxConnections {
+		RejectedConnections.Mark(1)
+		return nil, ErrTooManyConnections
+	}
+	state, ok := l.sources[source]
+	if !ok {
+		state = &sourceState{}
+		if l.Limits.IPLineRate > 0 {
+			state.bucket = NewTokenBucket(l.Limits.IPLineRate)
+		}
+		l.sources[source] = state
+	}
+	l.connections++
+	ActiveConnections.Update(int64(l.connections))
+	atomic.AddInt64(&state.connections, 1)
+	atomic.StoreInt64(&state.lastSeen, now.UnixNano())
+	connection := &LimitedConnection{limiter: l, source: state}
+	if l.Limits.ConnectionLineRate > 0 {
+		connection.bucket = NewTokenBucket(l.Limits.ConnectionLineRate)
+	}
+	return connection, nil
+}
+
+// Sources returns statistics of connected and recently disconnected sources ordered by address
+func (l *ConnectionLimiter) Sources() []SourceStats {
+	l.Lock()
+	defer l.Unlock()
+	l.expireSources(time.Now())
+	addresses := make([]string, 0, len(l.sources))
+	for address := range l.sources {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	stats := make([]SourceStats, 0, len(addresses))
+	for _, address := range addresses {
+		state := l.sources[address]
+		stats = append(stats, SourceStats{
+			Source:      address,
+			Connections: atomic.LoadInt64(&state.connections),
+			Lines:       atomic.LoadInt64(&state.lines),
+			Throttled:   atomic.LoadInt64(&state.throttled),
+			Dropped:     atomic.LoadInt64(&state.dropped),
+			LastSeen:    time.Unix(0, atomic.LoadInt64(&state.lastSeen)),
+		})
+	}
+	return stats
+}
+
+// Watch expires statistics of disconnected sources every sourcesExpireInterval until terminate
+func (l *ConnectionLimiter) Watch(terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-terminate:
+			return
+		case <-time.After(sourcesExpireInterval):
+			l.Lock()
+			l.expireSources(time.Now())
+			l.Unlock()
+		}
+	}
+}
+
+// expireSources forgets sources without connections not seen for sourceStatsTTL
+func (l *ConnectionLimiter) expireSources(now time.Time) {
+	for address, state := range l.sources {
+		if atomic.LoadInt64(&state.connections) == 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&state.lastSeen))) > sourceStatsTTL {
+			delete(l.sources, address)
+		}
+	}
+}
+
+// LimitedConnection counts and throttles lines of single connection
+type LimitedConnection struct {
+	limiter *ConnectionLimiter
+	source  *sourceState
+	bucket  *TokenBucket
+	closed  bool
+}
+
+// Wait counts received line and sleeps while connection or its source exceeds line rate
+func (c *LimitedConnection) Wait() {
+	now := time.Now()
+	atomic.AddInt64(&c.source.lines, 1)
+	atomic.StoreInt64(&c.source.lastSeen, now.UnixNano())
+	var delay time.Duration
+	if c.bucket != nil {
+		delay = c.bucket.Reserve(now)
+	}
+	if c.source.bucket != nil {
+		if sourceDelay := c.source.bucket.Reserve(now); sourceDelay > delay {
+			delay = sourceDelay
+		}
+	}
+	if delay > 0 {
+		atomic.AddInt64(&c.source.throttled, 1)
+		ThrottledLines.Mark(1)
+		time.Sleep(delay)
+	}
+}
+
+// Drop counts line dropped because it is longer than MaxLineLength
+func (c *LimitedConnection) Drop() {
+	atomic.AddInt64(&c.source.lines, 1)
+	atomic.AddInt64(&c.source.dropped, 1)
+	MarkDropped(DropReasonLineTooLong, 1)
+}
+
+// Close unregisters connection
+func (c *LimitedConnection) Close() {
+	c.limiter.Lock()
+	defer c.limiter.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.limiter.connections--
+	ActiveConnections.Update(int64(c.limiter.connections))
+	atomic.AddInt64(&c.source.connections, -1)
+	atomic.StoreInt64(&c.source.lastSeen, time.Now().UnixNano())
+}
@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// cacheEntryOverhead approximates memory used by map bucket, list element and item of every cache entry
+const cacheEntryOverhead = 160
+
+// expiredSweepLimit bounds number of expired entries removed on single set
+const expiredSweepLimit = 100
+
+type expiringCacheItem struct {
+	key     string
+	value   interface{}
+	size    int64
+	updated time.Time
+}
+
+// expiringCache is LRU cache bounded by approximate memory size
+// entries expire after ttl since last update
+type expiringCache struct {
+	sync.Mutex
+	items   map[string]*list.Element
+	order   *list.List
+	size    int64
+	maxSize int64
+	ttl     time.Duration
+
+	entriesGauge metrics.Gauge
+	bytesGauge   metrics.Gauge
+	expired      metrics.Meter
+	evicted      metrics.Meter
+}
+
+func newExpiringCache(name string, maxSize int64, ttl time.Duration) *expiringCache {
+	return &expiringCache{
+		items:        make(map[string]*list.Element),
+		order:        list.New(),
+		maxSize:      maxSize,
+		ttl:          ttl,
+		entriesGauge: metrics.GetOrRegisterGauge(fmt.Sprintf("lru.%s.entries", name), metrics.DefaultRegistry),
+		bytesGauge:   metrics.GetOrRegisterGauge(fmt.Sprintf("lru.%s.bytes", name), metrics.DefaultRegistry),
+		expired:      metrics.GetOrRegisterMeter(fmt.Sprintf("lru.%s.evicted.expired", name), metrics.DefaultRegistry),
+		evicted:      metrics.GetOrRegisterMeter(fmt.Sprintf("lru.%s.evicted.size", name), metrics.DefaultRegistry),
+	}
+}
+
+func (c *expiringCache) isExpired(item *expiringCacheItem, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(item.updated) > c.ttl
+}
+
+func (c *expiringCache) get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*expiringCacheItem)
+	if c.isExpired(item, time.Now()) {
+		c.remove(element)
+		c.expired.Mark(1)
+		c.updateGauges()
+		return nil, false
+	}
+	return item.value, true
+}
+
+// set stores value with its approximate size in bytes, cache entry overhead is added automatically
+func (c *expiringCache) set(key string, value interface{}, size int64) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	size += int64(len(key)) + cacheEntryOverhead
+	if element, ok := c.items[key]; ok {
+		item := element.Value.(*expiringCacheItem)
+		c.size += size - item.size
+		item.value = value
+		item.size = size
+		item.updated = now
+		c.order.MoveToFront(element)
+	} else {
+		c.items[key] = c.order.PushFront(&expiringCacheItem{
+			key:     key,
+			value:   value,
+			size:    size,
+			updated: now,
+		})
+		c.size += size
+	}
+
+	// entries are ordered by update time, so expired ones are always at the back
+	for i := 0; i < expiredSweepLimit; i++ {
+		back := c.order.Back()
+		if back == nil || !c.isExpired(back.Value.(*expiringCacheItem), now) {
+			break
+		}
+		c.remove(back)
+		c.expired.Mark(1)
+	}
+	for c.maxSize > 0 && c.size > c.maxSize && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+		c.evicted.Mark(1)
+	}
+	c.updateGauges()
+}
+
+func (c *expiringCache) remove(element *list.Element) {
+	item := c.order.Remove(element).(*expiringCacheItem)
+	delete(c.items, item.key)
+	c.size -= item.size
+}
+
+func (c *expiringCache) updateGauges() {
+	c.entriesGauge.Update(int64(c.order.Len()))
+	c.bytesGauge.Update(c.size)
+}
@@ -0,0 +1,230 @@
+package filter
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMemoryEventsLimit is number of last published events kept by MemoryStorage
+	defaultMemoryEventsLimit = 10000
+	// memoryExpireInterval is how often MemoryStorage removes metrics without points newer than MetricsTTL
+	memoryExpireInterval = time.Minute
+)
+
+// MetricPoint is single saved metric value
+type MetricPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
+// MetricEvent is notification about new point of metric matched by pattern
+type MetricEvent struct {
+	Metric  string
+	Pattern string
+	// Point is set for extended events payload only
+	Point *EventPoint
+}
+
+// MemoryStorage keeps patterns, points and events in process memory, it is used in tests and single-node setups
+type MemoryStorage struct {
+	sync.RWMutex
+	// MetricsTTL is number of seconds metric points are kept for, zero keeps them forever
+	// metrics without points newer than MetricsTTL are removed completely by ExpireMetrics
+	MetricsTTL int64
+	// EventsLimit is number of last published events kept
+	EventsLimit int
+	// EventsPayload makes events keep metric points if it is EventsPayloadExtended
+	EventsPayload EventsPayload
+
+	patterns   []string
+	points     map[string]map[int64]MetricPoint
+	retentions map[string]int
+	events     []MetricEvent
+	heartbeat  int64
+	states     map[string]InstanceState
+	lastWrite  time.Time
+	// latest is the newest retention timestamp of every metric
+	latest map[string]int64
+	// newest is the newest retention timestamp of all saved points
+	newest int64
+}
+
+// NewMemoryStorage creates empty memory storage with given patterns
+func NewMemoryStorage(patterns ...string) *MemoryStorage {
+	return &MemoryStorage{
+		EventsLimit: defaultMemoryEventsLimit,
+		patterns:    patterns,
+		points:      make(map[string]map[int64]MetricPoint),
+		retentions:  make(map[string]int),
+		latest:      make(map[string]int64),
+		states:      make(map[string]InstanceState),
+	}
+}
+
+// SetPatterns replaces patterns list
+func (storage *MemoryStorage) SetPatterns(patterns ...string) {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.patterns = patterns
+}
+
+// GetPatterns returns patterns list
+func (storage *MemoryStorage) GetPatterns() ([]string, error) {
+	storage.RLock()
+	defer storage.RUnlock()
+	return append([]string(nil), storage.patterns...), nil
+}
+
+// SavePoints saves metric points by retention timestamps and retentions, replacing points of the same retention interval
+func (storage *MemoryStorage) SavePoints(buffer map[string]*MatchedMetric) error {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.lastWrite = time.Now()
+	for _, m := range buffer {
+		if m.RetentionTimestamp > storage.newest {
+			storage.newest = m.RetentionTimestamp
+		}
+		if m.RetentionTimestamp > storage.latest[m.Metric] {
+			storage.latest[m.Metric] = m.RetentionTimestamp
+		}
+		points, ok := storage.points[m.Metric]
+		if !ok {
+			points = make(map[int64]MetricPoint)
+			storage.points[m.Metric] = points
+		}
+		points[m.RetentionTimestamp] = MetricPoint{Timestamp: m.Timestamp, Value: m.Value}
+		storage.retentions[m.Metric] = m.Retention
+		if storage.MetricsTTL > 0 {
+			for timestamp := range points {
+				if timestamp < m.RetentionTimestamp-storage.MetricsTTL {
+					delete(points, timestamp)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Watch removes expired metrics every memoryExpireInterval until terminate is closed
+func (storage *MemoryStorage) Watch(terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-terminate:
+			return
+		case <-time.After(memoryExpireInterval):
+			storage.ExpireMetrics()
+		}
+	}
+}
+
+// ExpireMetrics removes metrics without points newer than MetricsTTL before the newest saved point
+func (storage *MemoryStorage) ExpireMetrics() {
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.MetricsTTL <= 0 {
+		return
+	}
+	since := storage.newest - storage.MetricsTTL
+	for metric, latest := range storage.latest {
+		if latest < since {
+			delete(storage.points, metric)
+			delete(storage.retentions, metric)
+			delete(storage.latest, metric)
+		}
+	}
+}
+
+// PublishEvents keeps event for every pattern metric is matched by
+func (storage *MemoryStorage) PublishEvents(buffer map[string]*MatchedMetric) error {
+	storage.Lock()
+	defer storage.Unlock()
+	format := eventsFormat{payload: storage.EventsPayload}
+	for _, m := range buffer {
+		for _, pattern := range m.Patterns {
+			storage.events = append(storage.events, MetricEvent{Metric: m.Metric, Pattern: pattern, Point: newEventPoint(m, format)})
+		}
+	}
+	if storage.EventsLimit > 0 && len(storage.events) > storage.EventsLimit {
+		storage.events = append([]MetricEvent(nil), storage.events[len(storage.events)-storage.EventsLimit:]...)
+	}
+	return nil
+}
+
+// UpdateMetricsHeartbeat increments heartbeat counter
+func (storage *MemoryStorage) UpdateMetricsHeartbeat() error {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.heartbeat++
+	return nil
+}
+
+// UpdateInstanceState keeps the last state of instance
+func (storage *MemoryStorage) UpdateInstanceState(state *InstanceState) error {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.states[state.Instance] = *state
+	storage.lastWrite = time.Now()
+	return nil
+}
+
+// LastWrite returns time of the last saved points or instance state
+func (storage *MemoryStorage) LastWrite() time.Time {
+	storage.RLock()
+	defer storage.RUnlock()
+	return storage.lastWrite
+}
+
+// Points returns saved points of metric ordered by retention timestamps
+func (storage *MemoryStorage) Points(metric string) []MetricPoint {
+	storage.RLock()
+	defer storage.RUnlock()
+	timestamps := make([]int64, 0, len(storage.points[metric]))
+	for timestamp := range storage.points[metric] {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Sort(int64Slice(timestamps))
+	points := make([]MetricPoint, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		points = append(points, storage.points[metric][timestamp])
+	}
+	return points
+}
+
+// Retention returns saved retention of metric
+func (storage *MemoryStorage) Retention(metric string) (int, bool) {
+	storage.RLock()
+	defer storage.RUnlock()
+	retention, ok := storage.retentions[metric]
+	return retention, ok
+}
+
+// Events returns published events from the oldest one
+func (storage *MemoryStorage) Events() []MetricEvent {
+	storage.RLock()
+	defer storage.RUnlock()
+	return append([]MetricEvent(nil), storage.events...)
+}
+
+// Heartbeat returns heartbeat counter
+func (storage *MemoryStorage) Heartbeat() int64 {
+	storage.RLock()
+	defer storage.RUnlock()
+	return storage.heartbeat
+}
+
+// InstanceState returns the last state of instance
+func (storage *MemoryStorage) InstanceState(instance string) (InstanceState, bool) {
+	storage.RLock()
+	defer storage.RUnlock()
+	state, ok := storage.states[instance]
+	return state, ok
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
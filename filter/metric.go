@@ -1,15 +1,15 @@
 package filter
 
 import (
-	"fmt"
-	"log"
+	"encoding/json"
+	"math"
 	"strconv"
 	"sync/atomic"
 	"time"
 	"unicode"
 )
 
-// LogParseErrors flag to log parse errors
+// LogParseErrors flag to log parse errors, logged lines are rate limited by Rejects
 var LogParseErrors bool
 
 // MatchedMetric represent parsed and matched metric data
@@ -20,12 +20,50 @@ type MatchedMetric struct {
 	Timestamp          int64
 	RetentionTimestamp int64
 	Retention          int
+	// ReceivedAt is time metric line was received, it is zero for points replayed from spool
+	ReceivedAt time.Time `json:"-"`
+	// QueuedAt is time matched metric was sent to save queue
+	QueuedAt time.Time `json:"-"`
+}
+
+// JSONFloat is float encoded as JSON number or as "NaN", "+Inf" and "-Inf" strings if it is not finite
+type JSONFloat float64
+
+// MarshalJSON encodes non-finite value as string
+func (value JSONFloat) MarshalJSON() ([]byte, error) {
+	f := float64(value)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+// UnmarshalJSON decodes value from number or string
+func (value *JSONFloat) UnmarshalJSON(data []byte) error {
+	var f float64
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f = parsed
+	} else if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*value = JSONFloat(f)
+	return nil
 }
 
 var (
 	totalReceived   int64
 	validReceived   int64
 	matchedReceived int64
+	// timedLines counts lines to pick every TimingSampleRate-th one for timers
+	timedLines int64
 )
 
 // ParseMetricFromString parses metric from string
@@ -37,7 +75,7 @@ func ParseMetricFromString(line []byte) ([]byte, float64, int64, error) {
 	for i, b := range line {
 		r := rune(b)
 		if r > unicode.MaxASCII || !strconv.IsPrint(r) {
-			return nil, 0, 0, fmt.Errorf("non-ascii or non-printable chars in metric name: '%s'", line)
+			return nil, 0, 0, newParseError(ParseErrorNonASCII, "non-ascii or non-printable chars in metric name: '%s'", rejectedLine(line))
 		}
 		if b == ' ' {
 			parts[partIndex] = line[partOffset:i]
@@ -45,57 +83,103 @@ func ParseMetricFromString(line []byte) ([]byte, float64, int64, error) {
 			partIndex++
 		}
 		if partIndex > 2 {
-			return nil, 0, 0, fmt.Errorf("too many space-separated items: '%s'", line)
+			return nil, 0, 0, newParseError(ParseErrorTooManyItems, "too many space-separated items: '%s'", rejectedLine(line))
 		}
 	}
 
 	if partIndex < 2 {
-		return nil, 0, 0, fmt.Errorf("too few space-separated items: '%s'", line)
+		return nil, 0, 0, newParseError(ParseErrorTooFewItems, "too few space-separated items: '%s'", rejectedLine(line))
 	}
 
 	parts[partIndex] = line[partOffset:]
 
 	metric := parts[0]
 	if len(metric) < 1 {
-		return nil, 0, 0, fmt.Errorf("metric name is empty: '%s'", line)
+		return nil, 0, 0, newParseError(ParseErrorEmptyName, "metric name is empty: '%s'", rejectedLine(line))
 	}
 
 	value, err := strconv.ParseFloat(string(parts[1]), 64)
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("cannot parse value: '%s' (%s)", line, err)
+		return nil, 0, 0, newParseError(ParseErrorBadValue, "cannot parse value: '%s' (%s)", rejectedLine(line), numErrorReason(err))
 	}
 
 	timestamp, err := strconv.ParseInt(string(parts[2]), 10, 64)
 	if err != nil || timestamp == 0 {
-		return nil, 0, 0, fmt.Errorf("cannot parse timestamp: '%s' (%s)", line, err)
+		return nil, 0, 0, newParseError(ParseErrorBadTimestamp, "cannot parse timestamp: '%s' (%s)", rejectedLine(line), numErrorReason(err))
 	}
 
 	return metric, value, timestamp, nil
 }
 
+// processStages passes metric through stages in order, it returns false if any stage dropped metric
+func (t *PatternStorage) processStages(metric *[]byte, source string) bool {
+	for _, stage := range t.stages {
+		var ok bool
+		if *metric, ok = stage.ProcessMetric(*metric, source); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // ProcessIncomingMetric validates, parses and matches incoming raw string
 func (t *PatternStorage) ProcessIncomingMetric(lineBytes []byte) *MatchedMetric {
-	count := atomic.AddInt64(&totalReceived, 1)
+	return t.ProcessIncomingMetricFrom(lineBytes, "")
+}
+
+// ProcessIncomingMetricFrom validates, parses and matches incoming raw string received from source address
+func (t *PatternStorage) ProcessIncomingMetricFrom(lineBytes []byte, source string) *MatchedMetric {
+	atomic.AddInt64(&totalReceived, 1)
 
+	sampled := atomic.AddInt64(&timedLines, 1)%TimingSampleRate == 0
+	receivedAt := time.Now()
 	metric, value, timestamp, err := ParseMetricFromString(lineBytes)
+	var parsedAt time.Time
+	if sampled {
+		parsedAt = time.Now()
+		ParsingTimer.Update(parsedAt.Sub(receivedAt))
+	}
 	if err != nil {
-		if LogParseErrors {
-			log.Printf("cannot parse input: %s", err)
-		}
-
+		Rejects.Add(lineBytes, source, err)
 		return nil
 	}
 
 	atomic.AddInt64(&validReceived, 1)
 
-	matchingStart := time.Now()
+	if len(t.stages) > 0 {
+		passed := t.processStages(&metric, source)
+		if sampled {
+			stagedAt := time.Now()
+			StagesTimer.Update(stagedAt.Sub(parsedAt))
+			parsedAt = stagedAt
+		}
+		if !passed {
+			return nil
+		}
+	}
+
 	matched := t.MatchPattern(metric)
-	if count%10 == 0 {
-		MatchingTimer.UpdateSince(matchingStart)
+	matchedAt := time.Now()
+	if sampled {
+		MatchingTimer.Update(matchedAt.Sub(parsedAt))
 	}
 	if len(matched) > 0 {
+		for _, stage := range t.matchedStages {
+			if _, ok := stage.ProcessMetric(metric, source); !ok {
+				return nil
+			}
+		}
 		atomic.AddInt64(&matchedReceived, 1)
-		return &MatchedMetric{string(metric), matched, value, timestamp, timestamp, 60}
+		return &MatchedMetric{
+			Metric:             string(metric),
+			Patterns:           matched,
+			Value:              value,
+			Timestamp:          timestamp,
+			RetentionTimestamp: timestamp,
+			Retention:          60,
+			ReceivedAt:         receivedAt,
+			QueuedAt:           matchedAt,
+		}
 	}
 	return nil
 }
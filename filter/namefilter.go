@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// DropReasonFilter is reason of metric dropped by name filter
+const DropReasonFilter = "filter"
+
+// FilterMode defines whether metrics matching name filter rules are allowed or denied
+type FilterMode int
+
+const (
+	// FilterDeny drops metrics matching any rule
+	FilterDeny FilterMode = iota
+	// FilterAllow drops metrics not matching any rule
+	FilterAllow
+)
+
+// ParseFilterMode returns filter mode by its config name
+func ParseFilterMode(name string) (FilterMode, error) {
+	switch name {
+	case "", "deny":
+		return FilterDeny, nil
+	case "allow":
+		return FilterAllow, nil
+	}
+	return FilterDeny, fmt.Errorf("unknown filter mode: '%s'", name)
+}
+
+// FilterRuleStats is number of metrics matched by name filter rule
+type FilterRuleStats struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Matched int64  `json:"matched"`
+}
+
+type filterRule struct {
+	matched int64
+	glob    *Glob
+	regexp  *regexp.Regexp
+	// meter is filter.rule<N>.matched meter of rule by its number in checking order
+	meter metrics.Meter
+}
+
+func (rule *filterRule) match(metric []byte) bool {
+	if rule.glob != nil {
+		return rule.glob.Match(metric)
+	}
+	return rule.regexp.Match(metric)
+}
+
+// NameFilter is metric stage allowing or denying metrics by glob and regular expression rules,
+// globs are checked before regular expressions and the first matching rule is counted
+type NameFilter struct {
+	Mode  FilterMode
+	rules []*filterRule
+}
+
+// NewNameFilter compiles glob and regular expression rules
+func NewNameFilter(mode FilterMode, globs, regexps []string) (*NameFilter, error) {
+	filter := &NameFilter{Mode: mode}
+	for _, pattern := range globs {
+		glob, err := CompileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filter glob [%s]: %s", pattern, err.Error())
+		}
+		filter.rules = append(filter.rules, &filterRule{glob: glob})
+	}
+	for _, pattern := range regexps {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filter regexp [%s]: %s", pattern, err.Error())
+		}
+		filter.rules = append(filter.rules, &filterRule{regexp: compiled})
+	}
+	for i, rule := range filter.rules {
+		rule.meter = metrics.GetOrRegisterMeter(fmt.Sprintf("filter.rule%d.matched", i+1), metrics.DefaultRegistry)
+	}
+	return filter, nil
+}
+
+// ProcessMetric passes metric matching any rule in allow mode or not matching any rule in deny mode
+func (filter *NameFilter) ProcessMetric(metric []byte, source string) ([]byte, bool) {
+	matched := false
+	for _, rule := range filter.rules {
+		if rule.match(metric) {
+			atomic.AddInt64(&rule.matched, 1)
+			rule.meter.Mark(1)
+			matched = true
+			break
+		}
+	}
+	if matched == (filter.Mode == FilterAllow) {
+		return metric, true
+	}
+	MarkDropped(DropReasonFilter, 1)
+	return nil, false
+}
+
+// Stats returns number of metrics matched by every rule in checking order
+func (filter *NameFilter) Stats() []FilterRuleStats {
+	stats := make([]FilterRuleStats, 0, len(filter.rules))
+	for _, rule := range filter.rules {
+		ruleStats := FilterRuleStats{Matched: atomic.LoadInt64(&rule.matched)}
+		if rule.glob != nil {
+			ruleStats.Type, ruleStats.Pattern = "glob", rule.glob.Pattern
+		} else {
+			ruleStats.Type, ruleStats.Pattern = "regexp", rule.regexp.String()
+		}
+		stats = append(stats, ruleStats)
+	}
+	return stats
+}
@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// DropReasonNewNames is reason of metric dropped because new metric names arrive faster than allowed
+const DropReasonNewNames = "new_names"
+
+// NewNamesLimiter is matched metric stage limiting rate of metric names not seen recently to protect storage from
+// cardinality explosions, names are forgotten if they are not received for ttl to twice ttl.
+// All names are accepted and remembered during warmup after start, so known names are not throttled after restart
+type NewNamesLimiter struct {
+	sync.RWMutex
+	bucket    *TokenBucket
+	ttl       time.Duration
+	current   map[string]struct{}
+	previous  map[string]struct{}
+	rotatedAt time.Time
+	warmUntil time.Time
+	accepted  metrics.Meter
+	learned   metrics.Meter
+}
+
+// NewNewNamesLimiter creates limiter accepting rate new names per second after warmup
+func NewNewNamesLimiter(rate float64, ttl, warmup time.Duration) *NewNamesLimiter {
+	now := time.Now()
+	return &NewNamesLimiter{
+		bucket:    NewTokenBucket(rate),
+		ttl:       ttl,
+		current:   make(map[string]struct{}),
+		previous:  make(map[string]struct{}),
+		rotatedAt: now,
+		warmUntil: now.Add(warmup),
+		accepted:  metrics.GetOrRegisterMeter("new_names.accepted", metrics.DefaultRegistry),
+		learned:   metrics.GetOrRegisterMeter("new_names.warmup", metrics.DefaultRegistry),
+	}
+}
+
+// ProcessMetric passes known metric names and new ones while rate of new names is not exceeded
+func (limiter *NewNamesLimiter) ProcessMetric(metric []byte, source string) ([]byte, bool) {
+	limiter.RLock()
+	_, known := limiter.current[string(metric)]
+	limiter.RUnlock()
+	if known {
+		return metric, true
+	}
+
+	now := time.Now()
+	limiter.Lock()
+	defer limiter.Unlock()
+	if now.Sub(limiter.rotatedAt) >= limiter.ttl {
+		limiter.previous, limiter.current = limiter.current, make(map[string]struct{}, len(limiter.current))
+		limiter.rotatedAt = now
+	}
+	name := string(metric)
+	if _, known := limiter.current[name]; known {
+		return metric, true
+	}
+	if _, known := limiter.previous[name]; !known {
+		if now.Before(limiter.warmUntil) {
+			limiter.learned.Mark(1)
+		} else if limiter.bucket.Allow(now) {
+			limiter.accepted.Mark(1)
+		} else {
+			MarkDropped(DropReasonNewNames, 1)
+			return nil, false
+		}
+	}
+	limiter.current[name] = struct{}{}
+	return metric, true
+}
+
+// Known returns number of remembered metric names
+func (limiter *NewNamesLimiter) Known() int {
+	limiter.RLock()
+	defer limiter.RUnlock()
+	known := len(limiter.current)
+	for name := range limiter.previous {
+		if _, ok := limiter.current[name]; !ok {
+			known++
+		}
+	}
+	return known
+}
@@ -2,12 +2,13 @@ package filter
 
 import (
 	"fmt"
-	"log"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/moira-alert/cache/logging"
 	"github.com/vova616/xxhash"
 )
 
@@ -15,7 +16,13 @@ var asteriskHash = xxhash.Checksum32([]byte("*"))
 
 // PatternStorage contains pattern tree
 type PatternStorage struct {
+	// counters go first to be 64-bit aligned for atomic operations
+	patternsCount        int64
+	lastRefresh          int64
 	PatternTree          *PatternNode
+
+	stages        []MetricStage
+	matchedStages []MetricStage
 }
 
 // PatternNode contains pattern node
@@ -32,9 +39,9 @@ func NewPatternStorage() *PatternStorage {
 	return &PatternStorage{}
 }
 
-// DoRefresh builds pattern tree from redis data
-func (t *PatternStorage) DoRefresh(db *DbConnector) error {
-	patterns, err := db.getPatterns()
+// DoRefresh builds pattern tree from source patterns
+func (t *PatternStorage) DoRefresh(source PatternSource) error {
+	patterns, err := source.GetPatterns()
 	if err != nil {
 		return err
 	}
@@ -43,7 +50,7 @@ func (t *PatternStorage) DoRefresh(db *DbConnector) error {
 }
 
 // Refresh run infinite refresh of patterns tree
-func (t *PatternStorage) Refresh(db *DbConnector, terminate chan bool, wg *sync.WaitGroup) {
+func (t *PatternStorage) Refresh(source PatternSource, terminate chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for {
 		select {
@@ -51,9 +58,9 @@ func (t *PatternStorage) Refresh(db *DbConnector, terminate chan bool, wg *sync.
 			return
 		case <-time.After(time.Second):
 			timer := time.Now()
-			err := t.DoRefresh(db)
+			err := t.DoRefresh(source)
 			if err != nil {
-				log.Printf("pattern refresh failed: %s", err.Error())
+				logging.Errorf("pattern refresh failed: %s", err.Error())
 			}
 			BuildTreeTimer.UpdateSince(timer)
 		}
@@ -108,10 +115,25 @@ func (t *PatternStorage) buildTree(patterns []string) error {
 	}
 
 	t.PatternTree = newTree
+	atomic.StoreInt64(&t.patternsCount, int64(len(patterns)))
+	atomic.StoreInt64(&t.lastRefresh, time.Now().UnixNano())
 
 	return nil
 }
 
+// PatternsCount returns number of patterns tree was built from
+func (t *PatternStorage) PatternsCount() int {
+	return int(atomic.LoadInt64(&t.patternsCount))
+}
+
+// LastRefresh returns time pattern tree was built last time, zero time if it was never built
+func (t *PatternStorage) LastRefresh() time.Time {
+	if refresh := atomic.LoadInt64(&t.lastRefresh); refresh != 0 {
+		return time.Unix(0, refresh)
+	}
+	return time.Time{}
+}
+
 // MatchPattern returns array of matched patterns
 func (t *PatternStorage) MatchPattern(metric []byte) []string {
 	currentLevel := []*PatternNode{t.PatternTree}
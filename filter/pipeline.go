@@ -0,0 +1,167 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+// transientErrorPrefixes are redis error replies which may succeed on retry
+var transientErrorPrefixes = []string{
+	"LOADING",
+	"BUSY",
+	"TRYAGAIN",
+	"MASTERDOWN",
+	"CLUSTERDOWN",
+	"READONLY",
+	"OOM",
+	"NOSCRIPT",
+	"MOVED ",
+	"ASK ",
+	"ERR max number of clients reached",
+}
+
+type redisCommand struct {
+	name   string
+	args   []interface{}
+	script *luaScript
+	// asking is address of cluster node command must be sent to after ASK redirect
+	asking string
+	// err is the last error command failed with
+	err error
+}
+
+func newRedisCommand(name string, args ...interface{}) *redisCommand {
+	return &redisCommand{name: name, args: args}
+}
+
+// key returns the first key command operates on
+func (command *redisCommand) key() interface{} {
+	if command.name == "EVALSHA" || command.name == "EVAL" {
+		return command.args[2]
+	}
+	return command.args[0]
+}
+
+// evalFallback returns EVAL command with full script source instead of its hash
+func (command *redisCommand) evalFallback() *redisCommand {
+	args := make([]interface{}, len(command.args))
+	copy(args, command.args)
+	args[0] = command.script.source
+	return &redisCommand{name: "EVAL", args: args, script: command.script}
+}
+
+// isTransientError returns true for connection errors and redis replies which may succeed on retry
+func isTransientError(err error) bool {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return true
+	}
+	for _, prefix := range transientErrorPrefixes {
+		if strings.HasPrefix(string(redisErr), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func markCommandError(name string, transient bool) {
+	kind := "permanent"
+	if transient {
+		kind = "transient"
+	}
+	metrics.GetOrRegisterMeter(fmt.Sprintf("redis.errors.%s.%s", strings.ToLower(name), kind), metrics.DefaultRegistry).Mark(1)
+}
+
+// execute runs commands in pipeline, commands failed with transient errors are retried with exponential backoff
+// commands failed with permanent errors are counted and skipped
+func (connector *DbConnector) execute(commands []*redisCommand) error {
+	backoff := connector.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		failed, err := connector.pipeline(commands)
+		if len(failed) == 0 {
+			atomic.StoreInt64(&connector.lastWrite, time.Now().UnixNano())
+			return nil
+		}
+		if attempt >= connector.MaxRetries {
+			return fmt.Errorf("%d of %d commands failed after %d retries: %s", len(failed), len(commands), attempt, err.Error())
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > connector.MaxRetryBackoff {
+			backoff = connector.MaxRetryBackoff
+		}
+		commands = failed
+	}
+}
+
+// pipeline sends all commands at once and checks every reply
+// it returns commands to retry and the last transient error
+func (connector *DbConnector) pipeline(commands []*redisCommand) ([]*redisCommand, error) {
+	defer RedisTimer.UpdateSince(time.Now())
+	if connector.Cluster != nil {
+		return connector.Cluster.pipeline(commands)
+	}
+	c := connector.Pool.Get()
+	defer c.Close()
+	return pipelineOn(c, commands, false)
+}
+
+// pipelineOn sends commands over single connection preceding each one with ASKING if asking is set
+func pipelineOn(c redis.Conn, commands []*redisCommand, asking bool) ([]*redisCommand, error) {
+	for _, command := range commands {
+		if asking {
+			c.Send("ASKING")
+		}
+		if err := c.Send(command.name, command.args...); err != nil {
+			markCommandError(command.name, true)
+			return failAll(commands, err), err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return failAll(commands, err), err
+	}
+
+	var (
+		failed  []*redisCommand
+		lastErr error
+	)
+	for i, command := range commands {
+		if asking {
+			c.Receive()
+		}
+		_, err := c.Receive()
+		if err == nil {
+			continue
+		}
+		command.err = err
+		transient := isTransientError(err)
+		markCommandError(command.name, transient)
+		if _, ok := err.(redis.Error); !ok {
+			// connection is broken, replies to the rest of commands are lost
+			return append(failed, failAll(commands[i:], err)...), err
+		}
+		if transient {
+			if command.name == "EVALSHA" && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+				command = command.evalFallback()
+			}
+			failed = append(failed, command)
+			lastErr = err
+			continue
+		}
+		logging.Errorf("%s %v failed: %s", command.name, command.key(), err.Error())
+	}
+	return failed, lastErr
+}
+
+func failAll(commands []*redisCommand, err error) []*redisCommand {
+	for _, command := range commands {
+		command.err = err
+	}
+	return commands
+}
@@ -0,0 +1,117 @@
+package filter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	defaultMaxIdle     = 10
+	defaultIdleTimeout = 240 * time.Second
+)
+
+// RedisOptions are settings of every connection to redis
+type RedisOptions struct {
+	// DbID is database selected after connect, zero keeps default database
+	DbID int
+	// Username is ACL user, empty username authenticates with password only
+	Username string
+	Password string
+	// TLS enables encrypted connections if set
+	TLS            *tls.Config
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	// MaxIdle is number of idle connections kept in pool
+	MaxIdle int
+	// MaxActive limits number of connections in pool, callers wait for free connection, zero is unlimited
+	MaxActive int
+}
+
+// NewRedisTLSConfig loads optional CA and client certificate files for redis TLS connections
+func NewRedisTLSConfig(caFile, certFile, keyFile string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in [%s]", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// DialRedis opens connection to redis at addr, authenticates and selects database
+func DialRedis(addr string, options *RedisOptions) (redis.Conn, error) {
+	if options == nil {
+		options = &RedisOptions{}
+	}
+	dialer := &net.Dialer{Timeout: options.ConnectTimeout}
+	var (
+		netConn net.Conn
+		err     error
+	)
+	if options.TLS != nil {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", addr, options.TLS)
+	} else {
+		netConn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := redis.NewConn(netConn, options.ReadTimeout, options.WriteTimeout)
+	if options.Password != "" {
+		args := []interface{}{options.Password}
+		if options.Username != "" {
+			args = []interface{}{options.Username, options.Password}
+		}
+		if _, err := c.Do("AUTH", args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate on redis [%s]: %s", addr, err.Error())
+		}
+	}
+	if options.DbID != 0 {
+		if _, err := c.Do("SELECT", options.DbID); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to select db %d on redis [%s]: %s", options.DbID, addr, err.Error())
+		}
+	}
+	return c, nil
+}
+
+func newPool(options *RedisOptions, dial func() (redis.Conn, error)) *redis.Pool {
+	if options == nil {
+		options = &RedisOptions{}
+	}
+	maxIdle := options.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdle
+	}
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   options.MaxActive,
+		Wait:        options.MaxActive > 0,
+		IdleTimeout: defaultIdleTimeout,
+		Dial:        dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
@@ -0,0 +1,179 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/moira-alert/cache/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Classes of metric line parse errors
+const (
+	ParseErrorNonASCII     = "non_ascii"
+	ParseErrorTooManyItems = "too_many_items"
+	ParseErrorTooFewItems  = "too_few_items"
+	ParseErrorEmptyName    = "empty_name"
+	ParseErrorBadValue     = "bad_value"
+	ParseErrorBadTimestamp = "bad_timestamp"
+	// rejectUnknown is class of rejects which are not parse errors
+	rejectUnknown = "unknown"
+)
+
+// rejectClasses are all classes rejected lines are counted by
+var rejectClasses = []string{
+	ParseErrorNonASCII,
+	ParseErrorTooManyItems,
+	ParseErrorTooFewItems,
+	ParseErrorEmptyName,
+	ParseErrorBadValue,
+	ParseErrorBadTimestamp,
+	rejectUnknown,
+}
+
+const (
+	defaultRecentRejects  = 100
+	defaultRejectsLogRate = 10
+	// maxRejectLineLength limits length of rejected line kept and logged
+	maxRejectLineLength = 512
+)
+
+// Rejects keeps recent rejected lines and logs them if LogParseErrors is set
+var Rejects = NewRejectLog(defaultRecentRejects, defaultRejectsLogRate)
+
+// ParseError is metric line parse error with its class
+type ParseError struct {
+	Class   string
+	message string
+}
+
+func (err *ParseError) Error() string {
+	return err.message
+}
+
+func newParseError(class string, format string, args ...interface{}) *ParseError {
+	return &ParseError{Class: class, message: fmt.Sprintf(format, args...)}
+}
+
+// numErrorReason strips number from strconv error as it is quoted with the whole line already
+func numErrorReason(err error) error {
+	if numErr, ok := err.(*strconv.NumError); ok {
+		return numErr.Err
+	}
+	return err
+}
+
+// rejectedLine cuts line to maxRejectLineLength before it is formatted into error text
+func rejectedLine(line []byte) []byte {
+	if len(line) > maxRejectLineLength {
+		return line[:maxRejectLineLength]
+	}
+	return line
+}
+
+// Reject is rejected metric line
+type Reject struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Class  string    `json:"class"`
+	Error  string    `json:"error"`
+	Line   string    `json:"line"`
+}
+
+// RejectLog keeps ring of recent rejects and logs at most logRate of them per second
+type RejectLog struct {
+	sync.Mutex
+	recent     []Reject
+	next       int
+	logRate    int
+	second     int64
+	logged     int
+	suppressed int
+	meters     map[string]metrics.Meter
+}
+
+// NewRejectLog creates reject log keeping size recent rejects
+func NewRejectLog(size int, logRate int) *RejectLog {
+	meters := make(map[string]metrics.Meter, len(rejectClasses))
+	for _, class := range rejectClasses {
+		meters[class] = rejectedMeter(class)
+	}
+	return &RejectLog{
+		recent:  make([]Reject, 0, size),
+		logRate: logRate,
+		meters:  meters,
+	}
+}
+
+// SetLogRate sets maximum number of rejects logged per second
+func (rejects *RejectLog) SetLogRate(logRate int) {
+	rejects.Lock()
+	defer rejects.Unlock()
+	rejects.logRate = logRate
+}
+
+// Add counts reject by its class, remembers it and logs it unless log rate is exceeded
+func (rejects *RejectLog) Add(line []byte, source string, err error) {
+	class := rejectUnknown
+	if parseErr, ok := err.(*ParseError); ok {
+		class = parseErr.Class
+	}
+	if meter, ok := rejects.meters[class]; ok {
+		meter.Mark(1)
+	} else {
+		rejectedMeter(class).Mark(1)
+	}
+
+	reject := Reject{
+		Time:   time.Now(),
+		Source: source,
+		Class:  class,
+		Error:  err.Error(),
+		Line:   string(rejectedLine(line)),
+	}
+
+	rejects.Lock()
+	defer rejects.Unlock()
+	if len(rejects.recent) < cap(rejects.recent) {
+		rejects.recent = append(rejects.recent, reject)
+	} else if len(rejects.recent) > 0 {
+		rejects.recent[rejects.next] = reject
+		rejects.next = (rejects.next + 1) % len(rejects.recent)
+	}
+
+	if !LogParseErrors {
+		return
+	}
+	if second := reject.Time.Unix(); second != rejects.second {
+		if rejects.suppressed > 0 {
+			logging.Warningf("%d more rejected lines were not logged", rejects.suppressed)
+		}
+		rejects.second, rejects.logged, rejects.suppressed = second, 0, 0
+	}
+	if rejects.logged >= rejects.logRate {
+		rejects.suppressed++
+		return
+	}
+	rejects.logged++
+	logging.Infof("cannot parse input from %s: %s", source, err.Error())
+}
+
+// Recent returns recent rejects from the oldest one
+func (rejects *RejectLog) Recent() []Reject {
+	rejects.Lock()
+	defer rejects.Unlock()
+	recent := make([]Reject, 0, len(rejects.recent))
+	recent = append(recent, rejects.recent[rejects.next:]...)
+	return append(recent, rejects.recent[:rejects.next]...)
+}
+
+// RejectedCount returns total number of lines rejected with given class
+func RejectedCount(class string) int64 {
+	return rejectedMeter(class).Count()
+}
+
+func rejectedMeter(class string) metrics.Meter {
+	return metrics.GetOrRegisterMeter(fmt.Sprintf("rejected.%s", class), metrics.DefaultRegistry)
+}
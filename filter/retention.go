@@ -2,6 +2,9 @@ package filter
 
 var defaultRetention = 60
 
+// retentionCacheItemSize approximates memory used by retentionCacheItem
+const retentionCacheItemSize = 16
+
 type retentionCacheItem struct {
     value int
     timestamp int64
@@ -9,15 +12,17 @@ type retentionCacheItem struct {
 
 // GetRetention returns first matched retention for metric
 func (cs *CacheStorage) GetRetention(m *MatchedMetric) int {
-    if item, ok := cs.retentionsCache[m.Metric]; ok && item.timestamp + 60 > m.Timestamp {
-        return item.value
+    if value, ok := cs.retentionsCache.get(m.Metric); ok {
+        if item := value.(*retentionCacheItem); item.timestamp + 60 > m.Timestamp {
+            return item.value
+        }
     }
 	for _, matcher := range cs.retentions {
 		if matcher.pattern.MatchString(m.Metric) {
-            cs.retentionsCache[m.Metric] = &retentionCacheItem{
+            cs.retentionsCache.set(m.Metric, &retentionCacheItem{
                 value: matcher.retention,
                 timestamp: m.Timestamp,
-            }
+            }, retentionCacheItemSize)
 			return matcher.retention
 		}
 	}
@@ -0,0 +1,193 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moira-alert/cache/logging"
+)
+
+// carbonGroupReference is carbon style \1 group reference in rewrite replacement
+var carbonGroupReference = regexp.MustCompile(`\\(\d+)`)
+
+// RewriteRule replaces metric name matching regular expression
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// RewriteStep is rule applied to metric name by dry run
+type RewriteStep struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Result      string `json:"result"`
+}
+
+// RewriteResult shows how metric name would be rewritten
+type RewriteResult struct {
+	Metric string        `json:"metric"`
+	Result string        `json:"result"`
+	Steps  []RewriteStep `json:"steps"`
+}
+
+// ParseRewriteRules parses carbon rewrite-rules.conf format: "regexp = replacement" lines in [pre] section,
+// lines before any section are pre rules too, replacement may refer groups as $1, ${1} or \1
+// rule is split on the first " = " like carbon does, so both regexp and replacement may contain "="
+func ParseRewriteRules(reader io.Reader) ([]*RewriteRule, error) {
+	rules := make([]*RewriteRule, 0)
+	section := "pre"
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section != "pre" {
+				return nil, fmt.Errorf("line %d: only [pre] rules are supported, got [%s]", number, section)
+			}
+			continue
+		}
+		index := strings.Index(line, " = ")
+		if index >= 0 {
+			index++
+		} else {
+			index = strings.Index(line, "=")
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("line %d: rule must be 'regexp = replacement'", number)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(line[:index]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err.Error())
+		}
+		replacement := carbonGroupReference.ReplaceAllString(strings.TrimSpace(line[index+1:]), "$${$1}")
+		rules = append(rules, &RewriteRule{Pattern: pattern, Replacement: replacement})
+	}
+	return rules, scanner.Err()
+}
+
+// Rewriter is metric stage applying rewrite rules in order, rules file is reloaded when it changes
+type Rewriter struct {
+	fileName string
+	rules    atomic.Value
+	modTime  time.Time
+	size     int64
+	// failedModTime, failedSize and failure describe the last failed load, it is reported once
+	failedModTime time.Time
+	failedSize    int64
+	failure       string
+}
+
+// NewRewriter loads rewrite rules from file
+func NewRewriter(fileName string) (*Rewriter, error) {
+	rewriter := &Rewriter{fileName: fileName}
+	if _, err := rewriter.Reload(); err != nil {
+		return nil, err
+	}
+	return rewriter, nil
+}
+
+// NewRewriterWithRules creates rewriter with fixed rules
+func NewRewriterWithRules(rules []*RewriteRule) *Rewriter {
+	rewriter := &Rewriter{}
+	rewriter.rules.Store(rules)
+	return rewriter
+}
+
+// Rules returns current rewrite rules
+func (r *Rewriter) Rules() []*RewriteRule {
+	rules, _ := r.rules.Load().([]*RewriteRule)
+	return rules
+}
+
+// Reload loads rules file if it was changed since the last load, current rules are kept if new ones are invalid
+// failure is returned once, the same file is not loaded again until it changes
+func (r *Rewriter) Reload() (bool, error) {
+	info, err := os.Stat(r.fileName)
+	if err != nil {
+		return false, r.fail(time.Time{}, 0, err)
+	}
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		r.failure = ""
+		return false, nil
+	}
+	if r.failure != "" && info.ModTime().Equal(r.failedModTime) && info.Size() == r.failedSize {
+		return false, nil
+	}
+	file, err := os.Open(r.fileName)
+	if err != nil {
+		return false, r.fail(info.ModTime(), info.Size(), err)
+	}
+	defer file.Close()
+	rules, err := ParseRewriteRules(file)
+	if err != nil {
+		return false, r.fail(info.ModTime(), info.Size(), fmt.Errorf("invalid rewrite rules [%s]: %s", r.fileName, err.Error()))
+	}
+	r.modTime, r.size = info.ModTime(), info.Size()
+	r.failure = ""
+	r.rules.Store(rules)
+	return true, nil
+}
+
+// fail remembers failed load of file version and returns err unless it was returned for it already
+func (r *Rewriter) fail(modTime time.Time, size int64, err error) error {
+	if r.failure == err.Error() && modTime.Equal(r.failedModTime) && size == r.failedSize {
+		return nil
+	}
+	r.failedModTime, r.failedSize, r.failure = modTime, size, err.Error()
+	return err
+}
+
+// Watch reloads rules file every second until terminate
+func (r *Rewriter) Watch(terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-terminate:
+			return
+		case <-time.After(time.Second):
+			reloaded, err := r.Reload()
+			if err != nil {
+				logging.Errorf("rewrite rules reload failed: %s", err.Error())
+			} else if reloaded {
+				logging.Infof("loaded %d rewrite rules from %s", len(r.Rules()), r.fileName)
+			}
+		}
+	}
+}
+
+// ProcessMetric applies every matching rule to metric name in order, metric rewritten to empty name is dropped
+func (r *Rewriter) ProcessMetric(metric []byte, source string) ([]byte, bool) {
+	for _, rule := range r.Rules() {
+		if rule.Pattern.Match(metric) {
+			metric = rule.Pattern.ReplaceAll(metric, []byte(rule.Replacement))
+		}
+	}
+	return metric, len(metric) > 0
+}
+
+// DryRun shows how metric name would be rewritten by current rules
+func (r *Rewriter) DryRun(metric string) *RewriteResult {
+	result := &RewriteResult{Metric: metric, Result: metric, Steps: make([]RewriteStep, 0)}
+	for _, rule := range r.Rules() {
+		if !rule.Pattern.MatchString(result.Result) {
+			continue
+		}
+		result.Result = rule.Pattern.ReplaceAllString(result.Result, rule.Replacement)
+		result.Steps = append(result.Steps, RewriteStep{
+			Pattern:     rule.Pattern.String(),
+			Replacement: rule.Replacement,
+			Result:      result.Result,
+		})
+	}
+	return result
+}
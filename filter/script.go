@@ -0,0 +1,42 @@
+package filter
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// luaScript is redis script called by hash, redis caches script source on the first EVAL fallback
+type luaScript struct {
+	source string
+	hash   string
+}
+
+func newLuaScript(source string) *luaScript {
+	sum := sha1.Sum([]byte(source))
+	return &luaScript{
+		source: source,
+		hash:   hex.EncodeToString(sum[:]),
+	}
+}
+
+// command returns EVALSHA command of script with given keys and arguments
+func (script *luaScript) command(keys []interface{}, args ...interface{}) *redisCommand {
+	commandArgs := make([]interface{}, 0, 2+len(keys)+len(args))
+	commandArgs = append(commandArgs, script.hash, len(keys))
+	commandArgs = append(commandArgs, keys...)
+	commandArgs = append(commandArgs, args...)
+	return &redisCommand{name: "EVALSHA", args: commandArgs, script: script}
+}
+
+// saveMetricScript adds point to metric sorted set, trims points with scores less than ARGV[3] if it is set
+// and refreshes key ttl if ARGV[4] is positive
+var saveMetricScript = newLuaScript(`
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[4])
+end
+return 1
+`)
@@ -0,0 +1,63 @@
+package filter
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	metricsHeartbeatDbKey = "moira-selfstate:metrics-heartbeat"
+	cacheInstancesDbKey   = "moira-selfstate:cache-instances"
+	// DefaultSelfStateTTL is number of seconds instance state is kept after the last heartbeat
+	DefaultSelfStateTTL = 60
+)
+
+// InstanceState is self-state of single cache instance written with heartbeat
+type InstanceState struct {
+	// Instance identifies cache instance, hostname and listen address by default
+	Instance  string
+	Hostname  string
+	Version   string
+	StartTime int64
+	// LastReceived is unix time when metrics were received last time
+	LastReceived int64
+	// ReceivedRate and MatchedRate are per-second rates of received and matched metrics for the last minute
+	ReceivedRate  float64
+	MatchedRate   float64
+	PatternsCount int
+	// RedisLatency is duration of the previous state write
+	RedisLatency time.Duration
+}
+
+// fields returns state as flat list of hash fields and values
+func (state *InstanceState) fields() []interface{} {
+	return []interface{}{
+		"hostname", state.Hostname,
+		"version", state.Version,
+		"start_time", state.StartTime,
+		"last_received", state.LastReceived,
+		"received_rate", fmt.Sprintf("%.3f", state.ReceivedRate),
+		"matched_rate", fmt.Sprintf("%.3f", state.MatchedRate),
+		"patterns_count", state.PatternsCount,
+		"redis_latency_ms", fmt.Sprintf("%.3f", state.RedisLatency.Seconds()*1000),
+	}
+}
+
+// GetInstanceStateDbKey returns string redis key for self-state hash of cache instance
+func GetInstanceStateDbKey(instance string) string {
+	return fmt.Sprintf("moira-selfstate:cache:%s", instance)
+}
+
+// UpdateInstanceState writes instance state hash expiring after SelfStateTTL
+// and updates last heartbeat time of instance in instances sorted set
+// removing instances without heartbeats for SelfStateTTL from it
+func (connector *DbConnector) UpdateInstanceState(state *InstanceState) error {
+	key := GetInstanceStateDbKey(state.Instance)
+	now := time.Now().Unix()
+	return connector.execute([]*redisCommand{
+		newRedisCommand("HMSET", append([]interface{}{key}, state.fields()...)...),
+		newRedisCommand("EXPIRE", key, connector.SelfStateTTL),
+		newRedisCommand("ZADD", cacheInstancesDbKey, now, state.Instance),
+		newRedisCommand("ZREMRANGEBYSCORE", cacheInstancesDbKey, "-inf", fmt.Sprintf("(%d", now-connector.SelfStateTTL)),
+	})
+}
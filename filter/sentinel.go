@@ -0,0 +1,212 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/logging"
+)
+
+const (
+	sentinelTimeout         = time.Second
+	sentinelResolveInterval = 10 * time.Second
+	switchMasterChannel     = "+switch-master"
+)
+
+// SentinelResolver discovers current redis master through sentinels and follows its failovers
+type SentinelResolver struct {
+	sync.RWMutex
+	sentinels  []string
+	masterName string
+	master     string
+	options    *RedisOptions
+}
+
+// NewSentinelResolver creates resolver and discovers current master address,
+// options keep credentials and TLS of sentinels, their database and timeouts are ignored
+func NewSentinelResolver(sentinels []string, masterName string, options *RedisOptions) (*SentinelResolver, error) {
+	if len(sentinels) == 0 {
+		return nil, errors.New("no sentinels configured")
+	}
+	if options == nil {
+		options = &RedisOptions{}
+	}
+	resolver := &SentinelResolver{
+		sentinels:  sentinels,
+		masterName: masterName,
+		options:    options,
+	}
+	if _, err := resolver.Resolve(); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// Master returns last known master address
+func (r *SentinelResolver) Master() string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.master
+}
+
+// Resolve asks sentinels for current master address until the first one answers
+func (r *SentinelResolver) Resolve() (string, error) {
+	var lastErr error
+	for _, sentinel := range r.sentinels {
+		master, err := r.askSentinel(sentinel)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		r.setMaster(master)
+		return master, nil
+	}
+	return "", fmt.Errorf("failed to resolve master [%s]: %s", r.masterName, lastErr.Error())
+}
+
+// dial connects to sentinel with resolver credentials and TLS, zero readTimeout waits for replies forever
+func (r *SentinelResolver) dial(sentinel string, readTimeout time.Duration) (redis.Conn, error) {
+	options := *r.options
+	options.DbID = 0
+	options.ConnectTimeout = sentinelTimeout
+	options.ReadTimeout = readTimeout
+	options.WriteTimeout = sentinelTimeout
+	return DialRedis(sentinel, &options)
+}
+
+func (r *SentinelResolver) askSentinel(sentinel string) (string, error) {
+	c, err := r.dial(sentinel, sentinelTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	addr, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", r.masterName))
+	if err != nil {
+		return "", err
+	}
+	if len(addr) != 2 {
+		return "", fmt.Errorf("sentinel [%s] does not know master [%s]", sentinel, r.masterName)
+	}
+	return net.JoinHostPort(addr[0], addr[1]), nil
+}
+
+func (r *SentinelResolver) setMaster(master string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.master != master {
+		if r.master != "" {
+			logging.Warningf("redis master [%s] moved from %s to %s", r.masterName, r.master, master)
+		}
+		r.master = master
+	}
+}
+
+// Watch follows +switch-master notifications and periodically re-resolves master until terminate
+func (r *SentinelResolver) Watch(terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var subscriptionWG sync.WaitGroup
+	subscriptionWG.Add(1)
+	go r.subscribe(terminate, &subscriptionWG)
+	for {
+		select {
+		case <-terminate:
+			subscriptionWG.Wait()
+			return
+		case <-time.After(sentinelResolveInterval):
+			if _, err := r.Resolve(); err != nil {
+				logging.Errorf("sentinel refresh failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (r *SentinelResolver) subscribe(terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for i := 0; ; i++ {
+		sentinel := r.sentinels[i%len(r.sentinels)]
+		if err := r.listen(sentinel, terminate); err != nil {
+			logging.Errorf("sentinel [%s] subscription failed: %s", sentinel, err.Error())
+		}
+		select {
+		case <-terminate:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *SentinelResolver) listen(sentinel string, terminate chan bool) error {
+	c, err := r.dial(sentinel, 0)
+	if err != nil {
+		return err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-terminate:
+		case <-done:
+		}
+		c.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(switchMasterChannel); err != nil {
+		return err
+	}
+	for {
+		switch message := psc.Receive().(type) {
+		case redis.Message:
+			// <master name> <old ip> <old port> <new ip> <new port>
+			parts := strings.Split(string(message.Data), " ")
+			if len(parts) == 5 && parts[0] == r.masterName {
+				r.setMaster(net.JoinHostPort(parts[3], parts[4]))
+			}
+		case error:
+			select {
+			case <-terminate:
+				return nil
+			default:
+				return message
+			}
+		}
+	}
+}
+
+// sentinelConn remembers master address connection was opened to
+type sentinelConn struct {
+	redis.Conn
+	addr string
+}
+
+// NewSentinelPool returns redis.Pool connecting to current master discovered by resolver
+func NewSentinelPool(resolver *SentinelResolver, options *RedisOptions) *redis.Pool {
+	pool := newPool(options, func() (redis.Conn, error) {
+		addr := resolver.Master()
+		c, err := DialRedis(addr, options)
+		if err != nil {
+			resolver.Resolve()
+			return nil, err
+		}
+		role, err := redis.Values(c.Do("ROLE"))
+		if err != nil || len(role) == 0 || fmt.Sprintf("%s", role[0]) != "master" {
+			c.Close()
+			resolver.Resolve()
+			return nil, fmt.Errorf("redis [%s] is not master", addr)
+		}
+		return &sentinelConn{Conn: c, addr: addr}, nil
+	})
+	pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		if conn, ok := c.(*sentinelConn); ok && conn.addr != resolver.Master() {
+			return fmt.Errorf("redis master moved from %s", conn.addr)
+		}
+		_, err := c.Do("PING")
+		return err
+	}
+	return pool
+}
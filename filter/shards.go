@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"fmt"
+
+	"github.com/vova616/xxhash"
+)
+
+// OverflowPolicy defines what happens with metric when its shard buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks sender until shard buffer has free space
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered metric to make room for the new one
+	OverflowDropOldest
+	// OverflowDropNewest drops the new metric
+	OverflowDropNewest
+)
+
+// ParseOverflowPolicy returns overflow policy by its config name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "", "block":
+		return OverflowBlock, nil
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	case "drop_newest":
+		return OverflowDropNewest, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy: '%s'", name)
+}
+
+// MetricShards distributes matched metrics between save shards by metric name hash,
+// so every metric is always buffered and saved by the same shard
+type MetricShards struct {
+	Channels []chan *MatchedMetric
+	policy   OverflowPolicy
+}
+
+// NewMetricShards creates count shards each buffering up to bufferSize metrics
+func NewMetricShards(count int, bufferSize int, policy OverflowPolicy) *MetricShards {
+	if count < 1 {
+		count = 1
+	}
+	shards := &MetricShards{
+		Channels: make([]chan *MatchedMetric, count),
+		policy:   policy,
+	}
+	for i := range shards.Channels {
+		shards.Channels[i] = make(chan *MatchedMetric, bufferSize)
+	}
+	return shards
+}
+
+// Send puts metric to its shard channel according to overflow policy
+func (s *MetricShards) Send(m *MatchedMetric) {
+	ch := s.Channels[s.index(m.Metric)]
+	select {
+	case ch <- m:
+		return
+	default:
+	}
+
+	switch s.policy {
+	case OverflowDropNewest:
+		MarkDropped(DropReasonOverflowNewest, 1)
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-ch:
+				MarkDropped(DropReasonOverflowOldest, 1)
+			default:
+			}
+			select {
+			case ch <- m:
+				return
+			default:
+			}
+		}
+	default:
+		BlockedMetrics.Mark(1)
+		ch <- m
+	}
+}
+
+// Fill returns the highest ratio of buffered metrics to shard buffer size
+func (s *MetricShards) Fill() float64 {
+	fill := 0.0
+	for _, ch := range s.Channels {
+		if cap(ch) == 0 {
+			continue
+		}
+		if ratio := float64(len(ch)) / float64(cap(ch)); ratio > fill {
+			fill = ratio
+		}
+	}
+	return fill
+}
+
+// Pending returns number of metrics waiting in shard channels
+func (s *MetricShards) Pending() int {
+	pending := 0
+	for _, ch := range s.Channels {
+		pending += len(ch)
+	}
+	return pending
+}
+
+// Close closes all shard channels
+func (s *MetricShards) Close() {
+	for _, ch := range s.Channels {
+		close(ch)
+	}
+}
+
+func (s *MetricShards) index(metric string) uint32 {
+	return xxhash.Checksum32([]byte(metric)) % uint32(len(s.Channels))
+}
@@ -0,0 +1,430 @@
+package filter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	spoolSegmentSuffix = ".spool"
+	// spoolOffsetSuffix is suffix of file keeping replay offset of segment between restarts
+	spoolOffsetSuffix = ".offset"
+	// spoolCorruptedSuffix is appended to segments which can not be read any further
+	spoolCorruptedSuffix = ".corrupted"
+	spoolSegmentSize     = 16 * 1024 * 1024
+	// spoolRecordHeaderSize is size of record header: body length and number of points in body
+	spoolRecordHeaderSize = 8
+	// maxSpoolRecordSize limits record body length, longer ones come from damaged headers
+	maxSpoolRecordSize = 256 * 1024 * 1024
+
+	// DropReasonSpoolOverflow is reason of metrics dropped from spool exceeding its size
+	DropReasonSpoolOverflow = "spool_overflow"
+	// DropReasonSpoolExpired is reason of metrics dropped from spool as too old
+	DropReasonSpoolExpired = "spool_expired"
+	// DropReasonSpoolCorrupted is reason of metrics dropped from spool as unreadable
+	DropReasonSpoolCorrupted = "spool_corrupted"
+)
+
+// errSpoolSegmentCorrupted means record header is damaged and the rest of segment can not be read
+var errSpoolSegmentCorrupted = errors.New("spool segment is corrupted")
+
+// spoolMetric is spooled point, its value is JSONFloat so non-finite values are kept
+type spoolMetric struct {
+	*MatchedMetric
+	Value JSONFloat
+}
+
+type spoolSegment struct {
+	path      string
+	created   time.Time
+	size      int64
+	points    int64
+	offset    int64
+	replaying bool
+}
+
+// Spool is bounded on-disk write-ahead log of metric batches which failed to save
+// segments older than maxAge or exceeding maxSize total are dropped starting from the oldest one
+type Spool struct {
+	sync.Mutex
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	segments []*spoolSegment
+	writer   *os.File
+	size     int64
+
+	sizeGauge metrics.Gauge
+	ageGauge  metrics.Gauge
+	appended  metrics.Meter
+	replayed  metrics.Meter
+	corrupted metrics.Meter
+}
+
+// NewSpool opens spool in dir loading segments left from previous run
+func NewSpool(dir string, maxSize int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	spool := &Spool{
+		dir:       dir,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		sizeGauge: metrics.GetOrRegisterGauge("spool.size", metrics.DefaultRegistry),
+		ageGauge:  metrics.GetOrRegisterGauge("spool.age", metrics.DefaultRegistry),
+		appended:  metrics.GetOrRegisterMeter("spool.appended", metrics.DefaultRegistry),
+		replayed:  metrics.GetOrRegisterMeter("spool.replayed", metrics.DefaultRegistry),
+		corrupted: metrics.GetOrRegisterMeter("spool.corrupted", metrics.DefaultRegistry),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		created, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segment := &spoolSegment{
+			path:    filepath.Join(dir, file.Name()),
+			created: time.Unix(0, created),
+			size:    file.Size(),
+		}
+		segment.offset = readSpoolOffset(segment.path)
+		if segment.points, err = countSpoolPoints(segment.path, segment.offset); err != nil {
+			return nil, fmt.Errorf("failed to read spool segment [%s]: %s", segment.path, err.Error())
+		}
+		spool.segments = append(spool.segments, segment)
+		spool.size += segment.size
+	}
+	sort.Sort(spoolSegmentsByAge(spool.segments))
+	spool.Lock()
+	spool.updateGauges()
+	spool.Unlock()
+	return spool, nil
+}
+
+// Append writes batch to the end of spool
+func (s *Spool) Append(buffer map[string]*MatchedMetric) error {
+	batch := make([]spoolMetric, 0, len(buffer))
+	for _, m := range buffer {
+		batch = append(batch, spoolMetric{MatchedMetric: m, Value: JSONFloat(m.Value)})
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, spoolRecordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(batch)))
+	copy(record[spoolRecordHeaderSize:], body)
+
+	s.Lock()
+	defer s.Unlock()
+	s.dropExpired()
+
+	current := s.current()
+	if current == nil || current.size >= spoolSegmentSize {
+		if current, err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+	current.size += int64(len(record))
+	current.points += int64(len(batch))
+	s.size += int64(len(record))
+	s.appended.Mark(int64(len(batch)))
+
+	for s.maxSize > 0 && s.size > s.maxSize {
+		if !s.dropOldest(DropReasonSpoolOverflow) {
+			break
+		}
+	}
+	s.updateGauges()
+	return nil
+}
+
+// Empty returns true if spool has no batches to replay
+func (s *Spool) Empty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.segments) == 0
+}
+
+// Replay saves spooled batches in order they were appended
+// it stops on the first failed batch which will be replayed again next time, even after restart
+// undecodable records are skipped and segments with damaged headers are renamed aside for inspection
+func (s *Spool) Replay(save func(map[string]*MatchedMetric) error) (int64, error) {
+	var total int64
+	for {
+		segment := s.takeOldest()
+		if segment == nil {
+			return total, nil
+		}
+		points, err := s.replaySegment(segment, save)
+		total += points
+		s.Lock()
+		segment.replaying = false
+		if err == errSpoolSegmentCorrupted {
+			s.quarantine(segment)
+			err = nil
+		} else if err == nil {
+			s.remove(segment)
+		}
+		s.updateGauges()
+		s.Unlock()
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (s *Spool) replaySegment(segment *spoolSegment, save func(map[string]*MatchedMetric) error) (int64, error) {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(segment.offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var total int64
+	for {
+		body, points, err := readSpoolRecord(reader)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		var batch []spoolMetric
+		if err := json.Unmarshal(body, &batch); err != nil {
+			s.corrupted.Mark(1)
+			MarkDropped(DropReasonSpoolCorrupted, points)
+		} else {
+			buffer := make(map[string]*MatchedMetric, len(batch))
+			for _, m := range batch {
+				if m.MatchedMetric == nil {
+					continue
+				}
+				m.MatchedMetric.Value = float64(m.Value)
+				buffer[m.Metric] = m.MatchedMetric
+			}
+			if err := save(buffer); err != nil {
+				return total, err
+			}
+			total += points
+			s.replayed.Mark(points)
+		}
+		s.Lock()
+		segment.offset += int64(spoolRecordHeaderSize + len(body))
+		segment.points -= points
+		offset := segment.offset
+		s.Unlock()
+		if err := writeSpoolOffset(segment.path, offset); err != nil {
+			return total, err
+		}
+	}
+}
+
+// takeOldest marks the oldest segment as replaying, active segment is closed so new batches go to the next one
+func (s *Spool) takeOldest() *spoolSegment {
+	s.Lock()
+	defer s.Unlock()
+	s.dropExpired()
+	if len(s.segments) == 0 {
+		return nil
+	}
+	segment := s.segments[0]
+	if segment == s.current() {
+		s.writer.Close()
+		s.writer = nil
+	}
+	segment.replaying = true
+	return segment
+}
+
+func (s *Spool) current() *spoolSegment {
+	if s.writer == nil || len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) rotate() (*spoolSegment, error) {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	created := time.Now()
+	segment := &spoolSegment{
+		path:    filepath.Join(s.dir, fmt.Sprintf("%020d%s", created.UnixNano(), spoolSegmentSuffix)),
+		created: created,
+	}
+	writer, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.writer = writer
+	s.segments = append(s.segments, segment)
+	return segment, nil
+}
+
+func (s *Spool) dropExpired() {
+	if s.maxAge <= 0 {
+		return
+	}
+	for _, segment := range append([]*spoolSegment(nil), s.segments...) {
+		if time.Since(segment.created) <= s.maxAge {
+			return
+		}
+		s.drop(segment, DropReasonSpoolExpired)
+	}
+}
+
+// dropOldest removes the oldest segment which is neither replayed nor written
+func (s *Spool) dropOldest(reason string) bool {
+	for _, segment := range s.segments {
+		if s.drop(segment, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spool) drop(segment *spoolSegment, reason string) bool {
+	if segment.replaying || segment == s.current() {
+		return false
+	}
+	MarkDropped(reason, segment.points)
+	s.remove(segment)
+	return true
+}
+
+func (s *Spool) remove(segment *spoolSegment) {
+	if s.forget(segment) {
+		os.Remove(segment.path)
+		os.Remove(segment.path + spoolOffsetSuffix)
+	}
+}
+
+// quarantine drops unreadable rest of segment keeping its file aside
+func (s *Spool) quarantine(segment *spoolSegment) {
+	if s.forget(segment) {
+		s.corrupted.Mark(1)
+		MarkDropped(DropReasonSpoolCorrupted, segment.points)
+		os.Rename(segment.path, segment.path+spoolCorruptedSuffix)
+		os.Remove(segment.path + spoolOffsetSuffix)
+	}
+}
+
+func (s *Spool) forget(segment *spoolSegment) bool {
+	for i, existing := range s.segments {
+		if existing == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= segment.size
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spool) updateGauges() {
+	s.sizeGauge.Update(s.size)
+	if len(s.segments) == 0 {
+		s.ageGauge.Update(0)
+		return
+	}
+	s.ageGauge.Update(int64(time.Since(s.segments[0].created).Seconds()))
+}
+
+func readSpoolRecord(reader io.Reader) ([]byte, int64, error) {
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxSpoolRecordSize {
+		return nil, 0, errSpoolSegmentCorrupted
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// record was not completely written before crash
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	return body, int64(binary.BigEndian.Uint32(header[4:8])), nil
+}
+
+func countSpoolPoints(path string, offset int64) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var total int64
+	for {
+		_, points, err := readSpoolRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errSpoolSegmentCorrupted {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		total += points
+	}
+}
+
+// readSpoolOffset returns offset of the first record not replayed yet, zero if it was never saved
+func readSpoolOffset(path string) int64 {
+	data, err := ioutil.ReadFile(path + spoolOffsetSuffix)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// writeSpoolOffset saves replay offset replacing previous one atomically
+func writeSpoolOffset(path string, offset int64) error {
+	tmp := path + spoolOffsetSuffix + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+spoolOffsetSuffix)
+}
+
+type spoolSegmentsByAge []*spoolSegment
+
+func (s spoolSegmentsByAge) Len() int           { return len(s) }
+func (s spoolSegmentsByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s spoolSegmentsByAge) Less(i, j int) bool { return s[i].created.Before(s[j].created) }
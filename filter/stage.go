@@ -0,0 +1,19 @@
+package filter
+
+// MetricStage processes parsed metric name received from source address before pattern matching
+type MetricStage interface {
+	// ProcessMetric returns metric name to match, possibly rewritten, or false if metric is dropped
+	ProcessMetric(metric []byte, source string) ([]byte, bool)
+}
+
+// SetStages replaces stages metric names go through before matching in given order,
+// it must be called before metrics are processed
+func (t *PatternStorage) SetStages(stages ...MetricStage) {
+	t.stages = stages
+}
+
+// SetMatchedStages replaces stages metric names go through after they are matched by any pattern,
+// it must be called before metrics are processed
+func (t *PatternStorage) SetMatchedStages(stages ...MetricStage) {
+	t.matchedStages = stages
+}
@@ -0,0 +1,43 @@
+package filter
+
+import "time"
+
+// PatternSource provides patterns incoming metrics are matched against
+type PatternSource interface {
+	GetPatterns() ([]string, error)
+}
+
+// PointSink saves matched metric points and their retentions
+type PointSink interface {
+	SavePoints(buffer map[string]*MatchedMetric) error
+}
+
+// EventPublisher notifies checkers about new points of metrics matched by patterns
+type EventPublisher interface {
+	PublishEvents(buffer map[string]*MatchedMetric) error
+}
+
+// HeartbeatWriter reports that metrics are still being received and self-state of instance
+type HeartbeatWriter interface {
+	UpdateMetricsHeartbeat() error
+	UpdateInstanceState(state *InstanceState) error
+}
+
+// WriteTracker reports the last time storage accepted writes
+type WriteTracker interface {
+	LastWrite() time.Time
+}
+
+// Storage is backend implementing all storage roles, DbConnector is the default redis one
+type Storage interface {
+	PatternSource
+	PointSink
+	EventPublisher
+	HeartbeatWriter
+	WriteTracker
+}
+
+var (
+	_ Storage = (*DbConnector)(nil)
+	_ Storage = (*MemoryStorage)(nil)
+)
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"log"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/moira-alert/cache/filter"
+	"github.com/moira-alert/cache/logging"
 )
 
-func heartbeat(db *filter.DbConnector, terminate chan bool, wg *sync.WaitGroup) {
+func heartbeat(db filter.HeartbeatWriter, terminate chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
+	state := newInstanceState()
 	count := filter.TotalMetricsReceived.Count()
 	for {
 		select {
@@ -18,12 +20,39 @@ func heartbeat(db *filter.DbConnector, terminate chan bool, wg *sync.WaitGroup)
 		case <-time.After(time.Second * 5):
 			newCount := filter.TotalMetricsReceived.Count()
 			if newCount != count {
+				state.LastReceived = time.Now().Unix()
 				if err := db.UpdateMetricsHeartbeat(); err != nil {
-					log.Printf("Save state failed: %s", err.Error())
+					logging.Errorf("Save state failed: %s", err.Error())
 				} else {
 					count = newCount
 				}
 			}
+			state.ReceivedRate = filter.TotalMetricsReceived.Rate1()
+			state.MatchedRate = filter.MatchingMetricsReceived.Rate1()
+			state.PatternsCount = patterns.PatternsCount()
+			timer := time.Now()
+			if err := db.UpdateInstanceState(state); err != nil {
+				logging.Errorf("Save instance state failed: %s", err.Error())
+			} else {
+				state.RedisLatency = time.Since(timer)
+			}
 		}
 	}
 }
+
+func newInstanceState() *filter.InstanceState {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logging.Warningf("failed to get hostname: %s", err.Error())
+	}
+	state := &filter.InstanceState{
+		Instance:  instanceName,
+		Hostname:  hostname,
+		Version:   version,
+		StartTime: time.Now().Unix(),
+	}
+	if state.Instance == "" {
+		state.Instance = hostname + listen
+	}
+	return state
+}
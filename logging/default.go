@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"log"
+	"os"
+)
+
+var std = New(InfoLevel, LogfmtFormat, &writerOutput{w: os.Stderr})
+
+// SetDefault replaces default logger used by package functions and standard log package,
+// it is called once on startup before logging goroutines are started
+func SetDefault(logger *Logger) {
+	std = logger
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(logger.Writer(InfoLevel))
+}
+
+// Default returns default logger
+func Default() *Logger {
+	return std
+}
+
+// WithFields returns default logger adding fields to every message
+func WithFields(fields Fields) *Logger {
+	return std.WithFields(fields)
+}
+
+// Debugf logs message with debug level to default logger
+func Debugf(format string, args ...interface{}) {
+	std.logf(2, DebugLevel, format, args...)
+}
+
+// Infof logs message with info level to default logger
+func Infof(format string, args ...interface{}) {
+	std.logf(2, InfoLevel, format, args...)
+}
+
+// Warningf logs message with warning level to default logger
+func Warningf(format string, args ...interface{}) {
+	std.logf(2, WarningLevel, format, args...)
+}
+
+// Errorf logs message with error level to default logger
+func Errorf(format string, args ...interface{}) {
+	std.logf(2, ErrorLevel, format, args...)
+}
+
+// Fatalf logs message with fatal level to default logger and exits
+func Fatalf(format string, args ...interface{}) {
+	std.logf(2, FatalLevel, format, args...)
+	os.Exit(1)
+}
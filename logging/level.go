@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is logging severity, messages below logger level are skipped
+type Level int32
+
+// Logging levels from the most verbose one
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+	FatalLevel
+)
+
+var levelNames = []string{"debug", "info", "warning", "error", "fatal"}
+
+// journald priorities of levels, see syslog(3)
+var levelPriorities = []int{7, 6, 4, 3, 2}
+
+func (level Level) String() string {
+	if level < DebugLevel || level > FatalLevel {
+		return fmt.Sprintf("level(%d)", int32(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel parses level name from config, empty name is info level
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return InfoLevel, nil
+	case "warn":
+		return WarningLevel, nil
+	}
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return Level(level), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level [%s]", name)
+}
+
+// Format is log line format
+type Format int
+
+const (
+	// LogfmtFormat writes lines of key=value pairs
+	LogfmtFormat Format = iota
+	// JSONFormat writes lines of JSON objects
+	JSONFormat
+)
+
+// ParseFormat parses format name from config, empty name is logfmt
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "", "logfmt":
+		return LogfmtFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return LogfmtFormat, fmt.Errorf("unknown log format [%s]", name)
+}
@@ -0,0 +1,213 @@
+// Package logging provides leveled structured logging to stdout, journald or file
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var identifier = filepath.Base(os.Args[0])
+
+// Fields are structured context of log messages
+type Fields map[string]interface{}
+
+// Field is single structured context value
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+type entry struct {
+	time    time.Time
+	level   Level
+	caller  string
+	message string
+	fields  []Field
+}
+
+// Logger writes messages not below its level to output
+type Logger struct {
+	level  *int32
+	format Format
+	output Output
+	fields []Field
+	pid    int
+}
+
+// New creates logger
+func New(level Level, format Format, output Output) *Logger {
+	levelValue := int32(level)
+	return &Logger{
+		level:  &levelValue,
+		format: format,
+		output: output,
+		pid:    os.Getpid(),
+	}
+}
+
+// Level returns current logger level
+func (logger *Logger) Level() Level {
+	return Level(atomic.LoadInt32(logger.level))
+}
+
+// SetLevel changes level of logger and all loggers derived from it
+func (logger *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(logger.level, int32(level))
+}
+
+// WithFields returns logger adding fields to every message
+func (logger *Logger) WithFields(fields Fields) *Logger {
+	derived := *logger
+	derived.fields = make([]Field, 0, len(logger.fields)+len(fields))
+	derived.fields = append(derived.fields, logger.fields...)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		derived.fields = append(derived.fields, Field{Key: key, Value: fields[key]})
+	}
+	return &derived
+}
+
+// Reopen reopens log file after rotation
+func (logger *Logger) Reopen() error {
+	return logger.output.Reopen()
+}
+
+// Debugf logs message with debug level
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.logf(2, DebugLevel, format, args...)
+}
+
+// Infof logs message with info level
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.logf(2, InfoLevel, format, args...)
+}
+
+// Warningf logs message with warning level
+func (logger *Logger) Warningf(format string, args ...interface{}) {
+	logger.logf(2, WarningLevel, format, args...)
+}
+
+// Errorf logs message with error level
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.logf(2, ErrorLevel, format, args...)
+}
+
+// Fatalf logs message with fatal level and exits
+func (logger *Logger) Fatalf(format string, args ...interface{}) {
+	logger.logf(2, FatalLevel, format, args...)
+	os.Exit(1)
+}
+
+// Writer returns writer logging every written line with given level, it is used to redirect standard log package
+func (logger *Logger) Writer(level Level) io.Writer {
+	return &levelWriter{logger: logger, level: level}
+}
+
+type levelWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	// levelWriter.Write is called by log.Output called by log.Printf
+	w.logger.logf(4, w.level, "%s", bytes.TrimRight(p, "\n"))
+	return len(p), nil
+}
+
+// logf formats and writes message, depth is number of stack frames above logf to report caller of
+func (logger *Logger) logf(depth int, level Level, format string, args ...interface{}) {
+	if level < logger.Level() {
+		return
+	}
+	e := &entry{
+		time:    time.Now(),
+		level:   level,
+		message: fmt.Sprintf(format, args...),
+		fields:  logger.fields,
+	}
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		e.caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	var line []byte
+	if logger.format == JSONFormat {
+		line = logger.formatJSON(e)
+	} else {
+		line = logger.formatLogfmt(e)
+	}
+	if err := logger.output.Write(e, line); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write log: %s\n%s", err.Error(), line)
+	}
+}
+
+func (logger *Logger) formatJSON(e *entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, e.time.Format(timeFormat))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, e.level.String())
+	fmt.Fprintf(&buf, `,"pid":%d`, logger.pid)
+	if e.caller != "" {
+		buf.WriteString(`,"caller":`)
+		writeJSONValue(&buf, e.caller)
+	}
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, e.message)
+	for _, field := range e.fields {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, field.Key)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, field.Value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+func (logger *Logger) formatLogfmt(e *entry) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time=%s level=%s pid=%d", e.time.Format(timeFormat), e.level, logger.pid)
+	if e.caller != "" {
+		fmt.Fprintf(&buf, " caller=%s", e.caller)
+	}
+	buf.WriteString(" msg=")
+	writeLogfmtValue(&buf, e.message)
+	for _, field := range e.fields {
+		fmt.Fprintf(&buf, " %s=", field.Key)
+		writeLogfmtValue(&buf, fmt.Sprint(field.Value))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func writeLogfmtValue(buf *bytes.Buffer, value string) {
+	if value == "" || bytes.ContainsAny([]byte(value), " =\"\n\t") {
+		buf.WriteString(strconv.Quote(value))
+		return
+	}
+	buf.WriteString(value)
+}
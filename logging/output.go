@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// Output writes formatted entries
+type Output interface {
+	Write(e *entry, line []byte) error
+	// Reopen reopens underlying file after it was rotated
+	Reopen() error
+	Close() error
+}
+
+// NewOutput creates output by its config name: stdout, journald or file written to path
+func NewOutput(name string, path string) (Output, error) {
+	switch name {
+	case "", "stdout":
+		return &writerOutput{w: os.Stdout}, nil
+	case "journald":
+		return newJournaldOutput()
+	case "file":
+		return newFileOutput(path)
+	}
+	return nil, fmt.Errorf("unknown log output [%s]", name)
+}
+
+type writerOutput struct {
+	w io.Writer
+}
+
+func (output *writerOutput) Write(e *entry, line []byte) error {
+	_, err := output.w.Write(line)
+	return err
+}
+
+func (output *writerOutput) Reopen() error { return nil }
+func (output *writerOutput) Close() error  { return nil }
+
+type fileOutput struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+func newFileOutput(path string) (*fileOutput, error) {
+	output := &fileOutput{path: path}
+	if err := output.Reopen(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (output *fileOutput) Write(e *entry, line []byte) error {
+	output.Lock()
+	defer output.Unlock()
+	_, err := output.file.Write(line)
+	return err
+}
+
+// Reopen opens file by path again, so logrotate can move old file away without copytruncate
+func (output *fileOutput) Reopen() error {
+	file, err := os.OpenFile(output.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	output.Lock()
+	old := output.file
+	output.file = file
+	output.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (output *fileOutput) Close() error {
+	output.Lock()
+	defer output.Unlock()
+	return output.file.Close()
+}
+
+// journaldOutput sends entries to journald native protocol socket keeping fields as journal fields
+type journaldOutput struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func newJournaldOutput() (*journaldOutput, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Name: journaldSocket, Net: "unixgram"}
+	if _, err := os.Stat(journaldSocket); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("journald is not available: %s", err.Error())
+	}
+	return &journaldOutput{conn: conn, addr: addr}, nil
+}
+
+func (output *journaldOutput) Write(e *entry, line []byte) error {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", e.message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(levelPriorities[e.level]))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", identifier)
+	if e.caller != "" {
+		writeJournalField(&buf, "CODE_LINE", e.caller)
+	}
+	for _, field := range e.fields {
+		writeJournalField(&buf, journalFieldName(field.Key), fmt.Sprint(field.Value))
+	}
+	_, err := output.conn.WriteToUnix(buf.Bytes(), output.addr)
+	return err
+}
+
+func (output *journaldOutput) Reopen() error { return nil }
+func (output *journaldOutput) Close() error  { return output.conn.Close() }
+
+// writeJournalField writes field as KEY=value line or in binary form if value has new lines
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts field key to journal field name of uppercase letters, digits and underscores
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		return "F" + string(name)
+	}
+	return string(name)
+}
@@ -6,38 +6,95 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/cyberdelia/go-metrics-graphite"
-	"github.com/gosexy/to"
-	"github.com/gosexy/yaml"
+	"github.com/moira-alert/cache/api"
+	cacheconfig "github.com/moira-alert/cache/config"
 	"github.com/moira-alert/cache/filter"
+	"github.com/moira-alert/cache/logging"
 	"github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/goagain"
 )
 
+// drainReadTimeout is time lines in flight are read for after shutdown is started
+const drainReadTimeout = time.Second
+
+// incompleteLines counts lines cut by connections closed on shutdown
+var incompleteLines int64
+
 var (
 	configFileName          = flag.String("config", "/etc/moira/config.yml", "path config file")
 	logParseErrors          = flag.Bool("logParseErrors", false, "enable logging metric parse errors")
 	printVersion            = flag.Bool("version", false, "Print version and exit")
+	checkConfigOnly         = flag.Bool("check-config", false, "Validate config and retentions files and exit")
+	configWarnings          []string
 	pidFileName             string
 	logFileName             string
+	logLevel                logging.Level
+	logFormat               logging.Format
+	logOutput               string
 	listen                  string
+	instanceName            string
+	apiListen               string
+	apiToken                string
+	rejectsLogRate          int
+	apiReadyMaxWriteAge     int64
+	apiReadyMaxQueueFill    float64
 	redisURI                string
 	graphiteURI             string
 	graphitePrefix          string
 	graphiteInterval        int64
 	retentionConfigFileName string
 	dbID                    int
-	db                      *filter.DbConnector
+	redisOptions            *filter.RedisOptions
+	cacheMemoryLimit        int64
+	cacheTTL                int64
+	saveShards              int
+	saveBuffer              int
+	saveBatchSize           int
+	saveFlushInterval       int64
+	drainTimeout            int64
+	overflowPolicy          filter.OverflowPolicy
+	redisSentinels          []string
+	redisSentinelOptions    *filter.RedisOptions
+	redisCluster            []string
+	redisMasterName         string
+	redisMaxRetries         int
+	redisRetryBackoff       int64
+	redisMetricsTTL         int64
+	redisKeyTTL             int64
+	redisTrimSampling       int
+	redisEventsVersion      int
+	redisEventsTransport    filter.EventsTransport
+	redisEventsStream       string
+	redisEventsStreamMaxLen int64
+	redisEventsPayload      filter.EventsPayload
+	redisEventsEncoding     filter.EventsEncoding
+	redisSelfStateTTL       int64
+	spoolDir                string
+	spoolMaxSize            int64
+	spoolMaxAge             int64
+	storageType             string
+	storage                 filter.Storage
+	memoryPatterns          []string
+	memoryMetricsTTL        int64
 	cache                   *filter.CacheStorage
+	spool                   *filter.Spool
 	patterns                *filter.PatternStorage
+	connectionLimits        filter.ConnectionLimits
+	limiter                 *filter.ConnectionLimiter
+	aclRules                []*filter.ACLRule
+	rewriteRulesFileName    string
+	rewriter                *filter.Rewriter
+	nameFilter              *filter.NameFilter
+	newNamesLimiter         *filter.NewNamesLimiter
 
 	version = "undefined"
 )
@@ -52,119 +109,402 @@ func main() {
 		os.Exit(0)
 	}
 
-	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+	if *checkConfigOnly {
+		if err := checkConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		for _, warning := range configWarnings {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		fmt.Printf("config [%s] and retentions [%s] are valid\n", *configFileName, retentionConfigFileName)
+		os.Exit(0)
+	}
+
 	filter.LogParseErrors = *logParseErrors
-	log.SetPrefix(fmt.Sprintf("pid:%d ", syscall.Getpid()))
 
 	if err := readConfig(configFileName); err != nil {
-		log.Fatalf("error reading config [%s]: %s", *configFileName, err.Error())
+		logging.Fatalf("error reading config [%s]: %s", *configFileName, err.Error())
 	}
-	logFile, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	filter.Rejects.SetLogRate(rejectsLogRate)
+	output, err := logging.NewOutput(logOutput, logFileName)
 	if err != nil {
-		log.Fatalf("error opening log file [%s]: %s", logFileName, err.Error())
+		logging.Fatalf("error opening log output [%s]: %s", logOutput, err.Error())
+	}
+	defer output.Close()
+	logger := logging.New(logLevel, logFormat, output)
+	logging.SetDefault(logger)
+	for _, warning := range configWarnings {
+		logging.Warningf("%s", warning)
+	}
+	goagain.OnSIGHUP = func(l net.Listener) error {
+		return logger.Reopen()
+	}
+	goagain.OnSIGUSR1 = func(l net.Listener) error {
+		toggleDebugLevel(logger)
+		return nil
 	}
-	defer logFile.Close()
-	log.SetOutput(logFile)
 
 	err = ioutil.WriteFile(pidFileName, []byte(fmt.Sprint(syscall.Getpid())), 0644)
 	if err != nil {
-		log.Fatalf("error writing pid file [%s]: %s", pidFileName, err.Error())
+		logging.Fatalf("error writing pid file [%s]: %s", pidFileName, err.Error())
 	}
 
 	retentionConfigFile, err := os.Open(retentionConfigFileName)
 	if err != nil {
-		log.Fatalf("error open retentions file [%s]: %s", pidFileName, err.Error())
+		logging.Fatalf("error open retentions file [%s]: %s", retentionConfigFileName, err.Error())
 	}
 
 	filter.InitGraphiteMetrics()
 
-	db = filter.NewDbConnector(filter.NewRedisPool(redisURI, dbID))
+	terminate := make(chan bool)
+
+	var wg sync.WaitGroup
+
+	switch storageType {
+	case "memory":
+		logging.Infof("using in-memory storage, points are not shared with other processes")
+		memory := filter.NewMemoryStorage(memoryPatterns...)
+		memory.MetricsTTL = memoryMetricsTTL
+		if memory.MetricsTTL > 0 {
+			wg.Add(1)
+			go memory.Watch(terminate, &wg)
+		}
+		storage = memory
+	default:
+		storage = newRedisStorage(terminate, &wg)
+	}
 	patterns = filter.NewPatternStorage()
-	if err = patterns.DoRefresh(db); err != nil {
-		log.Fatalf("failed to refresh pattern storage: %s", err.Error())
+	if err = patterns.DoRefresh(storage); err != nil {
+		logging.Fatalf("failed to refresh pattern storage: %s", err.Error())
+	}
+	var stages []filter.MetricStage
+	if rewriteRulesFileName != "" {
+		if rewriter, err = filter.NewRewriter(rewriteRulesFileName); err != nil {
+			logging.Fatalf("failed to load rewrite rules: %s", err.Error())
+		}
+		logging.Infof("loaded %d rewrite rules from %s", len(rewriter.Rules()), rewriteRulesFileName)
+		stages = append(stages, rewriter)
+		wg.Add(1)
+		go rewriter.Watch(terminate, &wg)
+	}
+	if len(aclRules) > 0 {
+		logging.Infof("accepting metrics by %d acl rules", len(aclRules))
+		stages = append(stages, filter.NewACL(aclRules))
+	}
+	if nameFilter != nil {
+		stages = append(stages, nameFilter)
+	}
+	patterns.SetStages(stages...)
+	if newNamesLimiter != nil {
+		patterns.SetMatchedStages(newNamesLimiter)
 	}
 	cache, err = filter.NewCacheStorage(bufio.NewScanner(retentionConfigFile))
 	if err != nil {
-		log.Fatalf("failed to initialize cache with config [%s]: %s", retentionConfigFileName, err.Error())
+		logging.Fatalf("failed to initialize cache with config [%s]: %s", retentionConfigFileName, err.Error())
 	}
+	cache.SetCacheLimits(cacheMemoryLimit*1024*1024, time.Duration(cacheTTL)*time.Second)
+	cache.BatchSize = saveBatchSize
+	cache.FlushInterval = time.Duration(saveFlushInterval) * time.Millisecond
 
-	terminate := make(chan bool)
+	if spoolDir != "" {
+		spool, err = filter.NewSpool(spoolDir, spoolMaxSize*1024*1024, time.Duration(spoolMaxAge)*time.Second)
+		if err != nil {
+			logging.Fatalf("failed to open spool [%s]: %s", spoolDir, err.Error())
+		}
+	}
 
-	var wg sync.WaitGroup
+	if spool != nil {
+		wg.Add(1)
+		go replaySpool(spool, terminate, &wg)
+	}
 
 	wg.Add(1)
-	go patterns.Refresh(db, terminate, &wg)
+	go patterns.Refresh(storage, terminate, &wg)
 
 	wg.Add(1)
-	go heartbeat(db, terminate, &wg)
+	go heartbeat(storage, terminate, &wg)
 
 	if graphiteURI != "" {
 		graphiteAddr, _ := net.ResolveTCPAddr("tcp", graphiteURI)
 		go graphite.Graphite(metrics.DefaultRegistry, time.Duration(graphiteInterval)*time.Second, fmt.Sprintf("%s.cache", graphitePrefix), graphiteAddr)
 	}
 
+	shards := filter.NewMetricShards(saveShards, saveBuffer, overflowPolicy)
+	limiter = filter.NewConnectionLimiter(connectionLimits)
+	wg.Add(1)
+	go limiter.Watch(terminate, &wg)
+
+	if apiListen != "" {
+		handler := api.NewHandler(&api.Readiness{
+			Patterns:     patterns,
+			Cache:        cache,
+			Storage:      storage,
+			Shards:       shards,
+			MaxWriteAge:  time.Duration(apiReadyMaxWriteAge) * time.Second,
+			MaxQueueFill: apiReadyMaxQueueFill,
+		})
+		handler.Handle("/metrics", api.MetricsHandler(metrics.DefaultRegistry))
+		handler.Handle("/rejects", api.RejectsHandler(filter.Rejects))
+		handler.Handle("/loglevel", api.LogLevelHandler(logger, apiToken))
+		handler.Handle("/sources", api.SourcesHandler(limiter))
+		if rewriter != nil {
+			handler.Handle("/rewrite", api.RewriteHandler(rewriter))
+		}
+		if nameFilter != nil {
+			handler.Handle("/filter", api.FilterHandler(nameFilter))
+		}
+		wg.Add(1)
+		go api.Serve(apiListen, handler, terminate, &wg)
+	}
+
 	l, err := goagain.Listener()
 	if err != nil {
 		l, err = net.Listen("tcp", listen)
 		if err != nil {
-			log.Fatalf("failed to listen on [%s]: %s", listen, err.Error())
+			logging.Fatalf("failed to listen on [%s]: %s", listen, err.Error())
 		}
-		log.Printf("listening on %s", listen)
+		logging.Infof("listening on %s", listen)
 		wg.Add(1)
-		go serve(l, terminate, &wg)
+		go serve(l, shards, terminate, &wg)
 
 	} else {
-		log.Printf("resuming listening on %s", listen)
+		logging.Infof("resuming listening on %s", listen)
 
 		wg.Add(1)
-		go serve(l, terminate, &wg)
+		go serve(l, shards, terminate, &wg)
 
 		if err := goagain.Kill(); err != nil {
-			log.Fatalf("failed to kill parent process: %s", err.Error())
+			logging.Fatalf("failed to kill parent process: %s", err.Error())
 		}
 	}
 
 	if _, err := goagain.Wait(l); err != nil {
-		log.Fatalf("failed to block main goroutine: %s", err.Error())
+		logging.Fatalf("failed to block main goroutine: %s", err.Error())
 	}
 
-	log.Printf("shutting down")
+	logging.Infof("shutting down, draining for at most %d seconds", drainTimeout)
+	saved, spooled, lost := savedPoints.snapshot()
 	if err := l.Close(); err != nil {
-		log.Fatalf("failed to stop listening: %s", err.Error())
+		logging.Fatalf("failed to stop listening: %s", err.Error())
+	}
+	drained := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		drainSaved, drainSpooled, drainLost := savedPoints.snapshot()
+		logging.Infof("shutdown complete, flushed %d points, spooled %d points, lost %d points and %d incomplete lines",
+			drainSaved-saved, drainSpooled-spooled, drainLost-lost, atomic.LoadInt64(&incompleteLines))
+	case <-time.After(time.Duration(drainTimeout) * time.Second):
+		drainSaved, drainSpooled, drainLost := savedPoints.snapshot()
+		logging.Errorf("drain deadline exceeded, flushed %d points, spooled %d points, lost %d points, %d unsaved points and %d incomplete lines",
+			drainSaved-saved, drainSpooled-spooled, drainLost-lost, int64(shards.Pending())+cache.Pending(), atomic.LoadInt64(&incompleteLines))
+	}
+}
+
+// toggleDebugLevel switches logger between debug and configured level
+func toggleDebugLevel(logger *logging.Logger) {
+	level := logLevel
+	if logger.Level() != logging.DebugLevel {
+		level = logging.DebugLevel
+	}
+	logger.SetLevel(level)
+	logging.Infof("log level is %s", level)
+}
+
+func newRedisStorage(terminate chan bool, wg *sync.WaitGroup) *filter.DbConnector {
+	var db *filter.DbConnector
+	if len(redisSentinels) > 0 {
+		resolver, err := filter.NewSentinelResolver(redisSentinels, redisMasterName, redisSentinelOptions)
+		if err != nil {
+			logging.Fatalf("failed to discover redis master: %s", err.Error())
+		}
+		logging.Infof("redis master [%s] is %s", redisMasterName, resolver.Master())
+		wg.Add(1)
+		go resolver.Watch(terminate, wg)
+		db = filter.NewDbConnector(filter.NewSentinelPool(resolver, redisOptions))
+	} else if len(redisCluster) > 0 {
+		cluster, err := filter.NewClusterClient(redisCluster, redisOptions, nil)
+		if err != nil {
+			logging.Fatalf("failed to connect to redis cluster: %s", err.Error())
+		}
+		db = filter.NewDbConnector(nil)
+		db.Cluster = cluster
+	} else {
+		db = filter.NewDbConnector(filter.NewRedisPoolWithOptions(redisURI, redisOptions))
+	}
+	db.MaxRetries = redisMaxRetries
+	db.RetryBackoff = time.Duration(redisRetryBackoff) * time.Millisecond
+	db.MetricsTTL = redisMetricsTTL
+	db.KeyTTL = redisKeyTTL
+	db.TrimSampling = redisTrimSampling
+	db.EventsVersion = redisEventsVersion
+	db.EventsTransport = redisEventsTransport
+	db.EventsStream = redisEventsStream
+	db.EventsStreamMaxLen = redisEventsStreamMaxLen
+	db.EventsPayload = redisEventsPayload
+	db.EventsEncoding = redisEventsEncoding
+	db.SelfStateTTL = redisSelfStateTTL
+	if err := db.Ping(); err != nil {
+		logging.Fatalf("failed to connect to redis db %d: %s", dbID, err.Error())
 	}
-	wg.Wait()
-	log.Printf("shutdown complete")
+	return db
 }
 
 func readConfig(configFileName *string) error {
-	file, err := yaml.Open(*configFileName)
+	config, err := cacheconfig.Load(*configFileName)
+	if err != nil {
+		return err
+	}
+	configWarnings = config.Warnings()
+	pidFileName = config.Cache.Pid
+	logFileName = config.Cache.LogFile
+	logOutput = config.LogOutputName()
+	if logLevel, err = logging.ParseLevel(config.Cache.LogLevel); err != nil {
+		return err
+	}
+	if logFormat, err = logging.ParseFormat(config.Cache.LogFormat); err != nil {
+		return err
+	}
+	listen = config.Cache.Listen
+	instanceName = config.Cache.Instance
+	rejectsLogRate = config.Cache.RejectsLogRate
+	storageType = config.Cache.Storage
+	retentionConfigFileName = config.Cache.RetentionConfig
+	rewriteRulesFileName = config.Cache.RewriteRules
+	cacheMemoryLimit = config.Cache.CacheMemoryLimit
+	cacheTTL = config.Cache.CacheTTL
+	saveShards = config.Cache.SaveShards
+	saveBuffer = config.Cache.SaveBuffer
+	saveBatchSize = config.Cache.SaveBatchSize
+	saveFlushInterval = config.Cache.SaveFlushIntervalMs
+	drainTimeout = config.Cache.DrainTimeout
+	if overflowPolicy, err = filter.ParseOverflowPolicy(config.Cache.OverflowPolicy); err != nil {
+		return err
+	}
+	apiListen = config.API.Listen
+	apiToken = config.API.Token
+	apiReadyMaxWriteAge = config.API.ReadyMaxWriteAge
+	apiReadyMaxQueueFill = config.API.ReadyMaxQueueFill
+	memoryPatterns = config.Memory.Patterns
+	memoryMetricsTTL = config.Memory.MetricsTTL
+	graphiteURI = config.Graphite.URI
+	graphitePrefix = config.Graphite.Prefix
+	graphiteInterval = config.Graphite.Interval
+	filter.TimingSampleRate = config.Graphite.TimingSampleRate
+	spoolDir = config.Spool.Dir
+	spoolMaxSize = config.Spool.MaxSizeMb
+	spoolMaxAge = config.Spool.MaxAge
+	if aclRules, err = config.ACLRules(); err != nil {
+		return err
+	}
+	if nameFilter, err = config.NameFilter(); err != nil {
+		return err
+	}
+	newNamesLimiter = config.NewNamesLimiter()
+	connectionLimits = filter.ConnectionLimits{
+		MaxConnections:     config.Limits.MaxConnections,
+		IPLineRate:         config.Limits.IPLineRate,
+		ConnectionLineRate: config.Limits.ConnectionLineRate,
+		MaxLineLength:      config.Limits.MaxLineLength,
+		IdleTimeout:        time.Duration(config.Limits.IdleTimeout) * time.Second,
+	}
+
+	redis := &config.Redis
+	redisURI = fmt.Sprintf("%s:%d", redis.Host, redis.Port)
+	dbID = redis.DbID
+	redisSentinels = redis.Sentinels
+	redisMasterName = redis.MasterName
+	redisCluster = redis.Cluster
+	if redisOptions, err = readRedisOptions(redis); err != nil {
+		return err
+	}
+	redisSentinelOptions = &filter.RedisOptions{
+		Username: redis.SentinelUsername,
+		Password: redis.SentinelPassword,
+	}
+	if redis.SentinelTLS {
+		if redisSentinelOptions.TLS, err = filter.NewRedisTLSConfig(redis.TLSCAFile, redis.TLSCertFile, redis.TLSKeyFile, redis.TLSSkipVerify); err != nil {
+			return fmt.Errorf("Can't load redis sentinel TLS config: %s", err.Error())
+		}
+	}
+	redisMaxRetries = redis.MaxRetries
+	redisRetryBackoff = redis.RetryBackoffMs
+	redisMetricsTTL = redis.MetricsTTL
+	redisKeyTTL = redis.KeyTTL
+	redisTrimSampling = redis.TrimSampling
+	redisEventsVersion = redis.EventsVersion
+	if redisEventsTransport, err = filter.ParseEventsTransport(redis.EventsTransport); err != nil {
+		return err
+	}
+	if redisEventsPayload, err = filter.ParseEventsPayload(redis.EventsPayload); err != nil {
+		return err
+	}
+	if redisEventsEncoding, err = filter.ParseEventsEncoding(redis.EventsEncoding); err != nil {
+		return err
+	}
+	redisEventsStream = redis.EventsStream
+	redisEventsStreamMaxLen = redis.EventsStreamMaxLen
+	redisSelfStateTTL = redis.SelfStateTTL
+	return nil
+}
+
+func readRedisOptions(config *cacheconfig.RedisConfig) (*filter.RedisOptions, error) {
+	options := &filter.RedisOptions{
+		DbID:           config.DbID,
+		Username:       config.Username,
+		Password:       config.Password,
+		ConnectTimeout: time.Duration(config.ConnectTimeoutMs) * time.Millisecond,
+		ReadTimeout:    time.Duration(config.ReadTimeoutMs) * time.Millisecond,
+		WriteTimeout:   time.Duration(config.WriteTimeoutMs) * time.Millisecond,
+		MaxIdle:        config.MaxIdle,
+		MaxActive:      config.MaxActive,
+	}
+	if config.TLS {
+		tlsConfig, err := filter.NewRedisTLSConfig(config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile, config.TLSSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("Can't load redis TLS config: %s", err.Error())
+		}
+		options.TLS = tlsConfig
+	}
+	return options, nil
+}
+
+// checkConfig validates config, retentions and rewrite rules files
+func checkConfig() error {
+	if err := readConfig(configFileName); err != nil {
+		return err
+	}
+	retentionConfigFile, err := os.Open(retentionConfigFileName)
 	if err != nil {
-		return fmt.Errorf("Can't read config file [%s]: %s", *configFileName, err.Error())
-	}
-	pidFileName = to.String(file.Get("cache", "pid"))
-	logFileName = to.String(file.Get("cache", "log_file"))
-	listen = to.String(file.Get("cache", "listen"))
-	retentionConfigFileName = to.String(file.Get("cache", "retention-config"))
-	redisURI = fmt.Sprintf("%s:%s", to.String(file.Get("redis", "host")), to.String(file.Get("redis", "port")))
-	graphiteURI = to.String(file.Get("graphite", "uri"))
-	graphitePrefix = to.String(file.Get("graphite", "prefix"))
-	graphiteInterval = to.Int64(file.Get("graphite", "interval"))
-	dbID = int(to.Int64(file.Get("redis", "dbid")))
+		return fmt.Errorf("error open retentions file [%s]: %s", retentionConfigFileName, err.Error())
+	}
+	defer retentionConfigFile.Close()
+	if _, err := filter.NewCacheStorage(bufio.NewScanner(retentionConfigFile)); err != nil {
+		return fmt.Errorf("invalid retentions file [%s]: %s", retentionConfigFileName, err.Error())
+	}
+	if rewriteRulesFileName != "" {
+		if _, err := filter.NewRewriter(rewriteRulesFileName); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func serve(l net.Listener, terminate chan bool, wg *sync.WaitGroup) {
+func serve(l net.Listener, shards *filter.MetricShards, terminate chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
-	metricsChan := make(chan *filter.MatchedMetric, 10)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		cache.ProcessMatchedMetrics(metricsChan, func(buffer map[string]*filter.MatchedMetric) {
-			if err := cache.SavePoints(buffer, db); err != nil {
-				log.Printf("failed to save value in cache: %s", err.Error())
-			}
-		})
-	}()
+	for _, metricsChan := range shards.Channels {
+		wg.Add(1)
+		go func(ch chan *filter.MatchedMetric) {
+			defer wg.Done()
+			cache.ProcessMatchedMetrics(ch, func(buffer map[string]*filter.MatchedMetric) {
+				savePoints(spool, buffer)
+			})
+		}(metricsChan)
+	}
 	go func() {
 		for {
 			select {
@@ -180,47 +520,135 @@ func serve(l net.Listener, terminate chan bool, wg *sync.WaitGroup) {
 		conn, err := l.Accept()
 		if err != nil {
 			if goagain.IsErrClosing(err) {
-				log.Println("Listener closed")
+				logging.Infof("listener closed")
 				close(terminate)
 				break
 			}
-			log.Printf("failed to accept connection: %s", err.Error())
+			logging.Errorf("failed to accept connection: %s", err.Error())
 			continue
 		}
 		handleWG.Add(1)
-		go func(conn net.Conn, ch chan *filter.MatchedMetric) {
+		go func(conn net.Conn) {
 			defer handleWG.Done()
-			handleConnection(conn, ch, terminate, &handleWG)
-		}(conn, metricsChan)
+			handleConnection(conn, shards, terminate)
+		}(conn)
 	}
 	handleWG.Wait()
-	close(metricsChan)
+	shards.Close()
 }
 
-func handleConnection(conn net.Conn, ch chan *filter.MatchedMetric, terminate chan bool, wg *sync.WaitGroup) {
-	bufconn := bufio.NewReader(conn)
-
-	go func(conn net.Conn) {
-		<-terminate
+func handleConnection(conn net.Conn, shards *filter.MetricShards, terminate chan bool) {
+	source := conn.RemoteAddr().String()
+	ip := source
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		ip = host
+	}
+	limited, err := limiter.Open(ip)
+	if err != nil {
+		logging.Debugf("connection from %s refused: %s", source, err.Error())
 		conn.Close()
-	}(conn)
+		return
+	}
+	defer limited.Close()
+
+	limits := limiter.Limits
+	var bufconn *bufio.Reader
+	if limits.MaxLineLength > 0 {
+		// the longest line and its new line must fit the buffer
+		bufconn = bufio.NewReaderSize(conn, limits.MaxLineLength+1)
+	} else {
+		bufconn = bufio.NewReader(conn)
+	}
+
+	// on shutdown lines already sent by client are read until drainReadTimeout and connection is closed
+	deadline := &readDeadline{conn: conn}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-terminate:
+			deadline.drain()
+		case <-done:
+		}
+	}()
 
 	for {
-		lineBytes, err := bufconn.ReadBytes('\n')
+		if limits.IdleTimeout > 0 {
+			deadline.extend(limits.IdleTimeout)
+		}
+		lineBytes, tooLong, err := readLine(bufconn, limits.MaxLineLength > 0)
+		if tooLong {
+			limited.Drop()
+			logging.Debugf("dropped line longer than %d bytes from %s", limits.MaxLineLength, source)
+		}
 		if err != nil {
 			conn.Close()
-			if err != io.EOF {
-				log.Printf("read failed: %s", err)
+			select {
+			case <-terminate:
+				if len(lineBytes) > 0 {
+					atomic.AddInt64(&incompleteLines, 1)
+					logging.Debugf("dropped incomplete line from %s on shutdown", source)
+				}
+			default:
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					filter.IdleConnections.Mark(1)
+					logging.Debugf("closed idle connection from %s", source)
+				} else if err != io.EOF {
+					logging.Warningf("read failed: %s", err)
+				}
 			}
 			break
 		}
+		if tooLong {
+			continue
+		}
+		limited.Wait()
 		lineBytes = lineBytes[:len(lineBytes)-1]
-		wg.Add(1)
-		go func(ch chan *filter.MatchedMetric) {
-			defer wg.Done()
-			if m := patterns.ProcessIncomingMetric(lineBytes); m != nil {
-				ch <- m
-			}
-		}(ch)
+		if m := patterns.ProcessIncomingMetricFrom(lineBytes, source); m != nil {
+			shards.Send(m)
+		}
+	}
+}
+
+// readDeadline sets read deadline of connection, idle deadline is never set after drain one
+type readDeadline struct {
+	sync.Mutex
+	conn     net.Conn
+	draining bool
+}
+
+// extend moves deadline by idle timeout unless connection is drained
+func (d *readDeadline) extend(timeout time.Duration) {
+	d.set(timeout, false)
+}
+
+// drain sets deadline of reading lines already sent by client on shutdown
+func (d *readDeadline) drain() {
+	d.set(drainReadTimeout, true)
+}
+
+func (d *readDeadline) set(timeout time.Duration, drain bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.draining {
+		return
+	}
+	d.draining = drain
+	d.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// readLine reads line with new line, if limited lines longer than reader buffer are skipped and reported as too long
+func readLine(reader *bufio.Reader, limited bool) ([]byte, bool, error) {
+	if !limited {
+		line, err := reader.ReadBytes('\n')
+		return line, false, err
+	}
+	line, err := reader.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, false, err
+	}
+	for err == bufio.ErrBufferFull {
+		_, err = reader.ReadSlice('\n')
 	}
+	return nil, true, err
 }
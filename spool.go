@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	"github.com/moira-alert/cache/logging"
+)
+
+func replaySpool(spool *filter.Spool, terminate chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-terminate:
+			return
+		case <-time.After(time.Second):
+			if spool.Empty() {
+				continue
+			}
+			replayed, err := spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				return cache.SavePoints(buffer, storage)
+			})
+			if replayed > 0 {
+				logging.Infof("replayed %d spooled points", replayed)
+			}
+			if err != nil {
+				logging.Errorf("spool replay stopped: %s", err.Error())
+			}
+		}
+	}
+}
+
+// pointsCounter counts points passed to savePoints by their outcome
+type pointsCounter struct {
+	saved   int64
+	spooled int64
+	lost    int64
+}
+
+var savedPoints pointsCounter
+
+func (c *pointsCounter) snapshot() (saved, spooled, lost int64) {
+	return atomic.LoadInt64(&c.saved), atomic.LoadInt64(&c.spooled), atomic.LoadInt64(&c.lost)
+}
+
+// savePoints writes batch to redis, batches go to spool instead while it is not replayed completely
+// so points of the same metric are never saved out of order
+func savePoints(spool *filter.Spool, buffer map[string]*filter.MatchedMetric) {
+	count := int64(len(buffer))
+	if spool == nil || spool.Empty() {
+		err := cache.SavePoints(buffer, storage)
+		if err == nil {
+			atomic.AddInt64(&savedPoints.saved, count)
+			return
+		}
+		if spool == nil {
+			logging.Errorf("failed to save value in cache: %s", err.Error())
+			atomic.AddInt64(&savedPoints.lost, count)
+			return
+		}
+		logging.Warningf("failed to save value in cache, spooling %d points: %s", len(buffer), err.Error())
+	}
+	if err := spool.Append(buffer); err != nil {
+		logging.Errorf("failed to spool points: %s", err.Error())
+		atomic.AddInt64(&savedPoints.lost, count)
+		return
+	}
+	atomic.AddInt64(&savedPoints.spooled, count)
+}
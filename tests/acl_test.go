@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rcrowley/go-metrics"
+)
+
+var _ = Describe("Glob", func() {
+	It("should match whole metric name", func() {
+		glob, err := filter.CompileGlob("Shared.*.{cpu,mem}.use?")
+		Expect(err).ShouldNot(HaveOccurred())
+		for name, matched := range map[string]bool{
+			"Shared.host1.cpu.user":       true,
+			"Shared.host1.mem.used":       true,
+			"Shared.host1.disk.used":      false,
+			"Shared.host1.cpu":            false,
+			"Shared.host1.cpu.user.extra": false,
+			"Other.host1.cpu.user":        false,
+		} {
+			Expect(glob.Match([]byte(name))).To(Equal(matched), "failed name: '%s'", name)
+		}
+	})
+
+	It("should reject malformed glob", func() {
+		_, err := filter.CompileGlob("Shared.[a-")
+		Expect(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("ACL", func() {
+	var patterns *filter.PatternStorage
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		patterns = filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(filter.NewMemoryStorage("TeamA.*", "TeamB.*", "Shared.*.cpu"))).To(Succeed())
+		teamA, err := filter.NewACLRule("team-a", []string{"10.1.0.0/16"}, []string{"TeamA."}, []string{"Shared.*.cpu"})
+		Expect(err).ShouldNot(HaveOccurred())
+		teamB, err := filter.NewACLRule("team-b", []string{"10.2.0.0/16", "10.1.2.0/24"}, []string{"TeamB."}, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		patterns.SetStages(filter.NewACL([]*filter.ACLRule{teamA, teamB}))
+	})
+
+	process := func(line, source string) bool {
+		return patterns.ProcessIncomingMetricFrom([]byte(line), source) != nil
+	}
+
+	It("should accept metrics allowed by any rule of source", func() {
+		Expect(process("TeamA.metric 1 1234567890", "10.1.1.1:4242")).To(BeTrue())
+		Expect(process("Shared.host.cpu 1 1234567890", "10.1.1.1:4242")).To(BeTrue())
+		Expect(process("TeamA.metric 1 1234567890", "10.1.2.1:4242")).To(BeTrue())
+		Expect(process("TeamB.metric 1 1234567890", "10.1.2.1:4242")).To(BeTrue())
+	})
+
+	It("should register rejected counters of every rule and unknown sources", func() {
+		for _, name := range []string{"acl.team-a.rejected", "acl.team-b.rejected", "acl.unknown_source.rejected"} {
+			Expect(metrics.DefaultRegistry.Get(name)).NotTo(BeNil(), "missing meter '%s'", name)
+		}
+	})
+
+	It("should count rejected metrics by the first rule of source", func() {
+		beforeA := filter.ACLRejectedCount("team-a")
+		beforeB := filter.ACLRejectedCount("team-b")
+		Expect(process("TeamB.metric 1 1234567890", "10.1.1.1:4242")).To(BeFalse())
+		Expect(process("TeamA.metric 1 1234567890", "10.2.0.1:4242")).To(BeFalse())
+		Expect(process("TeamA.metric 1 1234567890", "10.2.0.1:4243")).To(BeFalse())
+		Expect(filter.ACLRejectedCount("team-a")).To(Equal(beforeA + 1))
+		Expect(filter.ACLRejectedCount("team-b")).To(Equal(beforeB + 2))
+	})
+
+	It("should reject sources out of rule networks", func() {
+		before := filter.ACLRejectedCount("unknown_source")
+		droppedBefore := filter.DroppedCount(filter.DropReasonACL)
+		Expect(process("TeamA.metric 1 1234567890", "192.168.0.1:4242")).To(BeFalse())
+		Expect(process("TeamA.metric 1 1234567890", "")).To(BeFalse())
+		Expect(filter.ACLRejectedCount("unknown_source")).To(Equal(before + 2))
+		Expect(filter.DroppedCount(filter.DropReasonACL)).To(Equal(droppedBefore + 2))
+	})
+
+	It("should validate rules", func() {
+		_, err := filter.NewACLRule("broken", []string{"10.1.0.0"}, []string{"TeamA."}, nil)
+		Expect(err).Should(HaveOccurred())
+		_, err = filter.NewACLRule("empty", []string{"10.1.0.0/16"}, nil, nil)
+		Expect(err).Should(HaveOccurred())
+	})
+})
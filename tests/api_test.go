@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/cache/api"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rcrowley/go-metrics"
+)
+
+type apiStatus struct {
+	Status string `json:"status"`
+	Checks []struct {
+		Name   string `json:"name"`
+		OK     bool   `json:"ok"`
+		Detail string `json:"detail"`
+	} `json:"checks"`
+}
+
+var _ = Describe("HTTP API", func() {
+	var (
+		storage   *filter.MemoryStorage
+		shards    *filter.MetricShards
+		readiness *api.Readiness
+	)
+
+	get := func(path string) (int, *apiStatus) {
+		recorder := httptest.NewRecorder()
+		api.NewHandler(readiness).ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		result := &apiStatus{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), result)).To(Succeed())
+		return recorder.Code, result
+	}
+
+	failedChecks := func(result *apiStatus) []string {
+		failed := make([]string, 0)
+		for _, check := range result.Checks {
+			if !check.OK {
+				failed = append(failed, check.Name)
+			}
+		}
+		return failed
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		storage = filter.NewMemoryStorage("Simple.*")
+		patterns := filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(storage)).To(Succeed())
+		cache, err := filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+		shards = filter.NewMetricShards(1, 2, filter.OverflowDropNewest)
+		readiness = &api.Readiness{
+			Patterns:     patterns,
+			Cache:        cache,
+			Storage:      storage,
+			Shards:       shards,
+			MaxWriteAge:  time.Minute,
+			MaxQueueFill: 0.9,
+		}
+	})
+
+	It("should report process is alive", func() {
+		code, result := get("/healthz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(result.Status).To(Equal("ok"))
+	})
+
+	It("should be ready after storage write", func() {
+		Expect(storage.SavePoints(map[string]*filter.MatchedMetric{})).To(Succeed())
+		code, result := get("/ready")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(result.Status).To(Equal("ok"))
+		Expect(result.Checks).To(HaveLen(4))
+	})
+
+	It("should not be ready before storage write", func() {
+		code, result := get("/ready")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(failedChecks(result)).To(Equal([]string{"storage"}))
+	})
+
+	It("should not be ready without pattern tree", func() {
+		Expect(storage.SavePoints(map[string]*filter.MatchedMetric{})).To(Succeed())
+		readiness.Patterns = filter.NewPatternStorage()
+		code, result := get("/ready")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(failedChecks(result)).To(Equal([]string{"patterns"}))
+	})
+
+	It("should not be ready when save queue is saturated", func() {
+		Expect(storage.SavePoints(map[string]*filter.MatchedMetric{})).To(Succeed())
+		shards.Send(&filter.MatchedMetric{Metric: "Simple.one"})
+		shards.Send(&filter.MatchedMetric{Metric: "Simple.two"})
+		code, result := get("/ready")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(failedChecks(result)).To(Equal([]string{"queue"}))
+	})
+})
+
+var _ = Describe("Prometheus metrics", func() {
+	It("should expose registry and runtime stats", func() {
+		registry := metrics.NewRegistry()
+		metrics.NewRegisteredMeter("received.total", registry).Mark(3)
+		metrics.NewRegisteredMeter("dropped.overflow_oldest", registry).Mark(2)
+		metrics.NewRegisteredGauge("lru.metrics.entries", registry).Update(7)
+		metrics.NewRegisteredTimer("time.save", registry).Update(2 * time.Second)
+
+		recorder := httptest.NewRecorder()
+		api.MetricsHandler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		body := recorder.Body.String()
+		Expect(body).To(ContainSubstring("# TYPE moira_cache_received_total counter\nmoira_cache_received_total 3\n"))
+		Expect(body).To(ContainSubstring("moira_cache_dropped_overflow_oldest_total 2\n"))
+		Expect(body).To(ContainSubstring("# TYPE moira_cache_lru_metrics_entries gauge\nmoira_cache_lru_metrics_entries 7\n"))
+		Expect(body).To(ContainSubstring("# TYPE moira_cache_time_save_seconds summary\n"))
+		Expect(body).To(ContainSubstring("moira_cache_time_save_seconds{quantile=\"0.99\"} 2\n"))
+		Expect(body).To(ContainSubstring("moira_cache_time_save_seconds_sum 2\nmoira_cache_time_save_seconds_count 1\n"))
+		Expect(body).To(ContainSubstring("# TYPE go_goroutines gauge\n"))
+	})
+
+	It("should suffix names colliding after sanitizing", func() {
+		registry := metrics.NewRegistry()
+		metrics.NewRegisteredGauge("queue.size", registry).Update(1)
+		metrics.NewRegisteredGauge("queue_size", registry).Update(2)
+		metrics.NewRegisteredMeter("lines", registry).Mark(3)
+		metrics.NewRegisteredMeter("lines.total", registry).Mark(4)
+
+		recorder := httptest.NewRecorder()
+		api.MetricsHandler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body := recorder.Body.String()
+		Expect(body).To(ContainSubstring("\nmoira_cache_queue_size 1\n"))
+		Expect(body).To(ContainSubstring("\nmoira_cache_queue_size_2 2\n"))
+		Expect(body).To(ContainSubstring("\nmoira_cache_lines_total 3\n"))
+		Expect(body).To(ContainSubstring("\nmoira_cache_lines_2_total 4\n"))
+		Expect(strings.Count(body, "# TYPE moira_cache_queue_size gauge\n")).To(Equal(1))
+	})
+})
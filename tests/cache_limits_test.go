@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache limits", func() {
+	var limitedCache *filter.CacheStorage
+
+	enrich := func(metric string) bool {
+		buffer := make(map[string]*filter.MatchedMetric)
+		limitedCache.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+			Metric:    metric,
+			Patterns:  []string{metric},
+			Value:     1,
+			Timestamp: 1234567890,
+		})
+		_, ok := buffer[metric]
+		return ok
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		var err error
+		limitedCache, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("When limits are not exceeded", func() {
+		It("should skip duplicate points", func() {
+			Expect(enrich("Simple.metric")).To(BeTrue())
+			Expect(enrich("Simple.metric")).To(BeFalse())
+		})
+	})
+
+	Context("When memory limit is exceeded", func() {
+		BeforeEach(func() {
+			limitedCache.SetCacheLimits(2, time.Hour)
+		})
+
+		It("should evict least recently updated metric", func() {
+			Expect(enrich("First.metric")).To(BeTrue())
+			Expect(enrich("Second.metric")).To(BeTrue())
+			Expect(enrich("Second.metric")).To(BeFalse())
+			Expect(enrich("First.metric")).To(BeTrue())
+		})
+	})
+
+	Context("When entry ttl is expired", func() {
+		BeforeEach(func() {
+			limitedCache.SetCacheLimits(1024*1024, time.Millisecond)
+		})
+
+		It("should forget metric", func() {
+			Expect(enrich("Simple.metric")).To(BeTrue())
+			time.Sleep(10 * time.Millisecond)
+			Expect(enrich("Simple.metric")).To(BeTrue())
+		})
+	})
+})
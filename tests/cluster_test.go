@@ -0,0 +1,261 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeSlotRange struct {
+	start int
+	end   int
+	addr  string
+}
+
+// fakeCluster is in-memory stand-in of redis cluster nodes answering with MOVED and ASK redirects
+type fakeCluster struct {
+	sync.Mutex
+	ranges    []fakeSlotRange
+	data      map[string]map[string][]string
+	migrating map[int]string
+	published int
+}
+
+func newFakeCluster(ranges ...fakeSlotRange) *fakeCluster {
+	cluster := &fakeCluster{
+		ranges:    ranges,
+		data:      make(map[string]map[string][]string),
+		migrating: make(map[int]string),
+	}
+	for _, slotRange := range ranges {
+		cluster.data[slotRange.addr] = make(map[string][]string)
+	}
+	return cluster
+}
+
+func (cluster *fakeCluster) owner(slot int) string {
+	for _, slotRange := range cluster.ranges {
+		if slot >= slotRange.start && slot <= slotRange.end {
+			return slotRange.addr
+		}
+	}
+	return ""
+}
+
+func (cluster *fakeCluster) nodeOf(key string) string {
+	cluster.Lock()
+	defer cluster.Unlock()
+	for addr, data := range cluster.data {
+		if _, ok := data[key]; ok {
+			return addr
+		}
+	}
+	return ""
+}
+
+func (cluster *fakeCluster) dial(addr string) (redis.Conn, error) {
+	return &fakeClusterConn{cluster: cluster, addr: addr}, nil
+}
+
+func (cluster *fakeCluster) execute(addr string, asking bool, command string, args []interface{}) (interface{}, error) {
+	cluster.Lock()
+	defer cluster.Unlock()
+	switch command {
+	case "PING":
+		return "PONG", nil
+	case "ASKING":
+		return "OK", nil
+	case "PUBLISH":
+		cluster.published++
+		return int64(1), nil
+	case "CLUSTER":
+		slots := make([]interface{}, 0, len(cluster.ranges))
+		for _, slotRange := range cluster.ranges {
+			host, port, _ := net.SplitHostPort(slotRange.addr)
+			portNumber, _ := strconv.Atoi(port)
+			slots = append(slots, []interface{}{
+				int64(slotRange.start), int64(slotRange.end), []interface{}{[]byte(host), int64(portNumber)},
+			})
+		}
+		return slots, nil
+	}
+
+	key := fmt.Sprint(args[0])
+	slot := filter.KeySlot(key)
+	owner := cluster.owner(slot)
+	target, migrating := cluster.migrating[slot]
+	_, exists := cluster.data[owner][key]
+	switch {
+	case addr == owner && migrating && !exists:
+		return nil, redis.Error(fmt.Sprintf("ASK %d %s", slot, target))
+	case addr != owner && !(asking && migrating && addr == target):
+		return nil, redis.Error(fmt.Sprintf("MOVED %d %s", slot, owner))
+	}
+
+	data := cluster.data[addr]
+	switch command {
+	case "ZADD", "SADD":
+		data[key] = append(data[key], fmt.Sprint(args[len(args)-1]))
+		return int64(1), nil
+	case "SET":
+		data[key] = []string{fmt.Sprint(args[1])}
+		return "OK", nil
+	case "INCR":
+		data[key] = append(data[key], "")
+		return int64(len(data[key])), nil
+	case "SMEMBERS":
+		members := make([]interface{}, 0, len(data[key]))
+		for _, member := range data[key] {
+			members = append(members, []byte(member))
+		}
+		return members, nil
+	}
+	return nil, redis.Error(fmt.Sprintf("ERR unknown command '%s'", command))
+}
+
+type fakeClusterConn struct {
+	cluster *fakeCluster
+	addr    string
+	pending [][]interface{}
+	asking  bool
+}
+
+func (c *fakeClusterConn) Close() error { return nil }
+func (c *fakeClusterConn) Err() error   { return nil }
+func (c *fakeClusterConn) Flush() error { return nil }
+
+func (c *fakeClusterConn) Send(command string, args ...interface{}) error {
+	c.pending = append(c.pending, append([]interface{}{command}, args...))
+	return nil
+}
+
+func (c *fakeClusterConn) Receive() (interface{}, error) {
+	command := c.pending[0]
+	c.pending = c.pending[1:]
+	name := command[0].(string)
+	reply, err := c.cluster.execute(c.addr, c.asking, name, command[1:])
+	c.asking = name == "ASKING"
+	return reply, err
+}
+
+func (c *fakeClusterConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command != "" {
+		c.Send(command, args...)
+	}
+	var (
+		reply interface{}
+		err   error
+	)
+	for len(c.pending) > 0 {
+		var replyErr error
+		reply, replyErr = c.Receive()
+		if replyErr != nil && err == nil {
+			err = replyErr
+		}
+	}
+	return reply, err
+}
+
+var _ = Describe("Redis cluster", func() {
+	var (
+		fake      *fakeCluster
+		connector *filter.DbConnector
+		storage   *filter.CacheStorage
+	)
+
+	testMetrics := []string{"Simple.one", "Simple.two", "Simple.three", "Simple.four", "Simple.five"}
+
+	save := func() {
+		buffer := make(map[string]*filter.MatchedMetric)
+		for _, metric := range testMetrics {
+			storage.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+				Metric:    metric,
+				Patterns:  []string{"Simple.*"},
+				Value:     12,
+				Timestamp: 1234567890,
+			})
+		}
+		Expect(storage.SavePoints(buffer, connector)).To(Succeed())
+	}
+
+	assertStoredOnOwners := func() {
+		for _, metric := range testMetrics {
+			for _, key := range []string{filter.GetMetricDbKey(metric), filter.GetMetricRetentionDbKey(metric)} {
+				Expect(fake.nodeOf(key)).To(Equal(fake.owner(filter.KeySlot(key))), "failed key: '%s'", key)
+			}
+		}
+		Expect(fake.published).To(Equal(len(testMetrics)))
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		fake = newFakeCluster(
+			fakeSlotRange{0, 5460, "127.0.0.1:7000"},
+			fakeSlotRange{5461, 10922, "127.0.0.1:7001"},
+			fakeSlotRange{10923, 16383, "127.0.0.1:7002"},
+		)
+		cluster, err := filter.NewClusterClient([]string{"127.0.0.1:7000"}, nil, fake.dial)
+		Expect(err).ShouldNot(HaveOccurred())
+		connector = filter.NewDbConnector(nil)
+		connector.Cluster = cluster
+		storage, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Describe("KeySlot", func() {
+		It("should match redis cluster slots", func() {
+			Expect(filter.KeySlot("123456789")).To(Equal(12739))
+			Expect(filter.KeySlot("{user1000}.following")).To(Equal(filter.KeySlot("{user1000}.followers")))
+			Expect(filter.KeySlot("foo{}{bar}")).NotTo(Equal(filter.KeySlot("bar")))
+		})
+	})
+
+	Context("When slots are stable", func() {
+		It("should save every key on its node", func() {
+			save()
+			assertStoredOnOwners()
+		})
+
+		It("should read patterns from node serving pattern list", func() {
+			fake.data[fake.owner(filter.KeySlot("moira-pattern-list"))]["moira-pattern-list"] = []string{"Simple.*"}
+			patternStorage := filter.NewPatternStorage()
+			Expect(patternStorage.DoRefresh(connector)).To(Succeed())
+			Expect(patternStorage.MatchPattern([]byte("Simple.one"))).To(Equal([]string{"Simple.*"}))
+		})
+	})
+
+	Context("When slots are moved", func() {
+		It("should follow MOVED redirects", func() {
+			fake.Lock()
+			fake.ranges = []fakeSlotRange{
+				{0, 10922, "127.0.0.1:7001"},
+				{10923, 16383, "127.0.0.1:7002"},
+			}
+			fake.Unlock()
+			save()
+			assertStoredOnOwners()
+		})
+	})
+
+	Context("When slot is migrating", func() {
+		It("should follow ASK redirects", func() {
+			key := filter.GetMetricDbKey(testMetrics[0])
+			slot := filter.KeySlot(key)
+			target := "127.0.0.1:7000"
+			if fake.owner(slot) == target {
+				target = "127.0.0.1:7001"
+			}
+			fake.migrating[slot] = target
+			save()
+			Expect(fake.nodeOf(key)).To(Equal(target))
+		})
+	})
+})
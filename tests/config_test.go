@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/moira-alert/cache/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+
+	write := func(content string) string {
+		path := filepath.Join(dir, "cache.yml")
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load packaged config", func() {
+		cfg, err := config.Load("../pkg/cache.yml")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cfg.Redis.Port).To(Equal(6379))
+		Expect(cfg.Graphite.Interval).To(Equal(int64(60)))
+		Expect(cfg.LogOutputName()).To(Equal("file"))
+		Expect(cfg.UnknownKeys()).To(BeEmpty())
+	})
+
+	It("should use defaults for missing keys", func() {
+		cfg, err := config.Load(write("cache:\n  listen: ':2004'\n"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cfg.Cache.Listen).To(Equal(":2004"))
+		Expect(cfg.Cache.SaveShards).To(Equal(4))
+		Expect(cfg.Redis.Host).To(Equal("localhost"))
+		Expect(cfg.Redis.EventsVersion).To(Equal(1))
+		Expect(cfg.Graphite.Interval).To(Equal(int64(60)))
+		Expect(cfg.LogOutputName()).To(Equal(""))
+	})
+
+	It("should report every invalid key", func() {
+		_, err := config.Load(write(`
+cache:
+  listen: ''
+  storage: disk
+  save_shards: 0
+  log_output: file
+redis:
+  port: 70000
+  events_transport: kafka
+graphite:
+  uri: localhost
+  interval: 0
+`))
+		validationErr, ok := err.(*config.ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(validationErr.Problems).To(ConsistOf(
+			"cache.listen is required",
+			"cache.storage must be redis or memory, got [disk]",
+			"cache.log_file is required",
+			"cache.save_shards must be positive, got 0",
+			"graphite.uri must be host:port, got [localhost]",
+			"graphite.interval must be positive, got 0",
+		))
+	})
+
+	It("should validate redis section for redis storage only", func() {
+		_, err := config.Load(write("cache:\n  storage: memory\nredis:\n  port: 0\n"))
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = config.Load(write("redis:\n  sentinels:\n    - sentinel1:26379\n"))
+		Expect(err).To(MatchError("invalid config: redis.master_name is required"))
+	})
+
+	It("should override keys by environment", func() {
+		cfg := config.Default()
+		Expect(cfg.ApplyEnv([]string{
+			"PATH=/bin",
+			"MOIRA_CACHE_REDIS_HOST=redis.local",
+			"MOIRA_CACHE_REDIS_PORT=6380",
+			"MOIRA_CACHE_REDIS_TLS=true",
+			"MOIRA_CACHE_REDIS_CLUSTER=redis1:6379, redis2:6379",
+			"MOIRA_CACHE_CACHE_RETENTION_CONFIG=/tmp/schemas.conf",
+			"MOIRA_CACHE_API_READY_MAX_QUEUE_FILL=0.5",
+		})).To(Succeed())
+		Expect(cfg.Redis.Host).To(Equal("redis.local"))
+		Expect(cfg.Redis.Port).To(Equal(6380))
+		Expect(cfg.Redis.TLS).To(BeTrue())
+		Expect(cfg.Redis.Cluster).To(Equal([]string{"redis1:6379", "redis2:6379"}))
+		Expect(cfg.Cache.RetentionConfig).To(Equal("/tmp/schemas.conf"))
+		Expect(cfg.API.ReadyMaxQueueFill).To(Equal(0.5))
+
+		Expect(cfg.ApplyEnv([]string{"MOIRA_CACHE_REDIS_PORT=redis"})).Should(HaveOccurred())
+	})
+
+	It("should ignore unknown variables and Kubernetes service links", func() {
+		cfg := config.Default()
+		Expect(cfg.ApplyEnv([]string{
+			"MOIRA_CACHE_PORT=tcp://10.0.0.1:2003",
+			"MOIRA_CACHE_SERVICE_HOST=10.0.0.1",
+			"MOIRA_CACHE_SERVICE_PORT=2003",
+			"MOIRA_CACHE_PORT_2003_TCP=tcp://10.0.0.1:2003",
+			"MOIRA_CACHE_PORT_2003_TCP_PROTO=tcp",
+			"MOIRA_CACHE_PORT_2003_TCP_PORT=2003",
+			"MOIRA_CACHE_PORT_2003_TCP_ADDR=10.0.0.1",
+			"MOIRA_CACHE_REDIS_PORT=tcp://10.0.0.2:6379",
+			"MOIRA_CACHE_REDIS_HOTS=redis",
+		})).To(Succeed())
+		Expect(cfg.Redis.Port).To(Equal(6379))
+		Expect(cfg.IgnoredEnv()).To(HaveLen(9))
+		Expect(cfg.Warnings()).To(ContainElement("ignored environment variable MOIRA_CACHE_REDIS_HOTS"))
+	})
+
+	It("should ignore variables of keys not supported in environment", func() {
+		cfg := config.Default()
+		Expect(cfg.ApplyEnv([]string{
+			"MOIRA_CACHE_ACL_RULES=team-a",
+			"MOIRA_CACHE_REDIS_HOST=redis.local",
+		})).To(Succeed())
+		Expect(cfg.Redis.Host).To(Equal("redis.local"))
+		Expect(cfg.ACL.Rules).To(BeEmpty())
+		Expect(cfg.IgnoredEnv()).To(Equal([]string{"MOIRA_CACHE_ACL_RULES"}))
+		Expect(cfg.Warnings()).To(ContainElement("ignored environment variable MOIRA_CACHE_ACL_RULES, acl.rules can be set in config file only"))
+	})
+
+	It("should validate acl rules", func() {
+		cfg, err := config.Load(write(`
+acl:
+  rules:
+    - name: team-a
+      networks: [10.1.0.0/16]
+      prefixes: [TeamA.]
+`))
+		Expect(err).ShouldNot(HaveOccurred())
+		rules, err := cfg.ACLRules()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rules).To(HaveLen(1))
+
+		_, err = config.Load(write(`
+acl:
+  rules:
+    - name: team a
+      networks: [10.1.0.0/16]
+      prefixes: [TeamA.]
+    - name: team a
+      networks: [10.1.0.0]
+      globs: [TeamA.*]
+`))
+		validationErr, ok := err.(*config.ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(validationErr.Problems).To(HaveLen(4))
+	})
+
+	It("should report unknown keys of known sections", func() {
+		cfg, err := config.Load(write("cache:\n  save_shard: 8\nnotifier:\n  sender: mail\n"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cfg.UnknownKeys()).To(Equal([]string{"cache.save_shard"}))
+	})
+})
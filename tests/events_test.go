@@ -0,0 +1,234 @@
+package tests
+
+import (
+	"bufio"
+	"math"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metric events", func() {
+	var (
+		conn      *scriptedConn
+		connector *filter.DbConnector
+		storage   *filter.CacheStorage
+	)
+
+	save := func(metrics map[string][]string) {
+		buffer := make(map[string]*filter.MatchedMetric)
+		for metric, patterns := range metrics {
+			storage.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+				Metric:    metric,
+				Patterns:  patterns,
+				Value:     12,
+				Timestamp: 1234567890,
+			})
+		}
+		Expect(storage.SavePoints(buffer, connector)).To(Succeed())
+	}
+
+	executed := func(name string) []string {
+		events := make([]string, 0)
+		for _, command := range conn.executed {
+			if command == name {
+				events = append(events, command)
+			}
+		}
+		return events
+	}
+	published := func() []string { return executed("PUBLISH") }
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		conn = &scriptedConn{errors: make(map[string][]error)}
+		connector = filter.NewDbConnector(&redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		})
+		var err error
+		storage, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	metrics := map[string][]string{
+		"Simple.one": {"Simple.*", "*.one"},
+		"Simple.two": {"Simple.*"},
+	}
+
+	Context("When events are not batched", func() {
+		It("should publish event per metric and pattern", func() {
+			save(metrics)
+			Expect(published()).To(HaveLen(3))
+			Expect(conn.arguments["PUBLISH"][0]).To(Equal("metric-event"))
+		})
+	})
+
+	Context("When events are batched", func() {
+		It("should publish single versioned event grouped by patterns", func() {
+			connector.EventsVersion = filter.EventsVersionBatch
+			save(metrics)
+			Expect(published()).To(HaveLen(1))
+			Expect(conn.arguments["PUBLISH"]).To(HaveLen(2))
+			Expect(conn.arguments["PUBLISH"][0]).To(Equal("metric-events-v2"))
+			Expect(string(conn.arguments["PUBLISH"][1].([]byte))).To(MatchJSON(`{
+				"version": 2,
+				"events": [
+					{"pattern": "*.one", "metrics": ["Simple.one"]},
+					{"pattern": "Simple.*", "metrics": ["Simple.one", "Simple.two"]}
+				]
+			}`))
+		})
+
+		It("should not publish empty event", func() {
+			connector.EventsVersion = filter.EventsVersionBatch
+			save(map[string][]string{"Simple.one": {}})
+			Expect(published()).To(BeEmpty())
+		})
+	})
+
+	Context("When events are appended to stream", func() {
+		It("should add capped stream entries instead of publishing", func() {
+			connector.EventsTransport = filter.EventsTransportStream
+			connector.EventsStreamMaxLen = 1000
+			save(metrics)
+			Expect(published()).To(BeEmpty())
+			Expect(executed("XADD")).To(HaveLen(3))
+			Expect(conn.arguments["XADD"][:6]).To(Equal([]interface{}{"moira-metric-events", "MAXLEN", "~", int64(1000), "*", "event"}))
+			Expect(conn.arguments["XADD"][7:]).To(Equal([]interface{}{"version", filter.EventsVersionSingle}))
+		})
+
+		It("should publish and append batched event when both transports are used", func() {
+			connector.EventsTransport = filter.EventsTransportBoth
+			connector.EventsVersion = filter.EventsVersionBatch
+			save(metrics)
+			Expect(published()).To(HaveLen(1))
+			Expect(executed("XADD")).To(HaveLen(1))
+			Expect(conn.arguments["XADD"][6]).To(Equal(conn.arguments["PUBLISH"][1]))
+			Expect(conn.arguments["XADD"][7:]).To(Equal([]interface{}{"version", filter.EventsVersionBatch}))
+		})
+	})
+
+	Describe("ParseEventsTransport", func() {
+		It("should parse known transports", func() {
+			for name, expected := range map[string]filter.EventsTransport{
+				"":       filter.EventsTransportPubSub,
+				"pubsub": filter.EventsTransportPubSub,
+				"stream": filter.EventsTransportStream,
+				"both":   filter.EventsTransportBoth,
+			} {
+				transport, err := filter.ParseEventsTransport(name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(transport).To(Equal(expected))
+			}
+			_, err := filter.ParseEventsTransport("kafka")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("When extended payload is used", func() {
+		BeforeEach(func() {
+			connector.EventsPayload = filter.EventsPayloadExtended
+		})
+
+		tagged := map[string][]string{"cpu;host=web1;dc=east": {"cpu;*"}}
+
+		It("should add point and tags to JSON event", func() {
+			save(tagged)
+			Expect(string(conn.arguments["PUBLISH"][1].([]byte))).To(MatchJSON(`{
+				"metric": "cpu;host=web1;dc=east",
+				"pattern": "cpu;*",
+				"value": 12,
+				"timestamp": 1234567890,
+				"retention_timestamp": 1234567920,
+				"retention": 60,
+				"tags": {"host": "web1", "dc": "east"}
+			}`))
+		})
+
+		saveValue := func(value float64) {
+			buffer := make(map[string]*filter.MatchedMetric)
+			storage.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+				Metric:    "Simple.one",
+				Patterns:  []string{"Simple.*"},
+				Value:     value,
+				Timestamp: 1234567890,
+			})
+			Expect(storage.SavePoints(buffer, connector)).To(Succeed())
+		}
+
+		It("should send non-finite values as strings in single events", func() {
+			saveValue(math.NaN())
+			Expect(published()).To(HaveLen(1))
+			Expect(string(conn.arguments["PUBLISH"][1].([]byte))).To(ContainSubstring(`"value":"NaN"`))
+			Expect(filter.FailedEvents.Count()).To(BeZero())
+		})
+
+		It("should send non-finite values as strings in batched events", func() {
+			connector.EventsVersion = filter.EventsVersionBatch
+			saveValue(math.Inf(-1))
+			Expect(published()).To(HaveLen(1))
+			Expect(string(conn.arguments["PUBLISH"][1].([]byte))).To(ContainSubstring(`"value":"-Inf"`))
+			Expect(filter.FailedEvents.Count()).To(BeZero())
+		})
+
+		It("should add points to batched JSON event", func() {
+			connector.EventsVersion = filter.EventsVersionBatch
+			save(tagged)
+			Expect(string(conn.arguments["PUBLISH"][1].([]byte))).To(MatchJSON(`{
+				"version": 2,
+				"events": [{
+					"pattern": "cpu;*",
+					"metrics": ["cpu;host=web1;dc=east"],
+					"points": {"cpu;host=web1;dc=east": {
+						"value": 12,
+						"timestamp": 1234567890,
+						"retention_timestamp": 1234567920,
+						"retention": 60,
+						"tags": {"host": "web1", "dc": "east"}
+					}}
+				}]
+			}`))
+		})
+
+		It("should decode binary event", func() {
+			connector.EventsEncoding = filter.EventsEncodingBinary
+			connector.EventsVersion = filter.EventsVersionBatch
+			save(tagged)
+			version, events, err := filter.DecodeBinaryEvents(conn.arguments["PUBLISH"][1].([]byte))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(version).To(Equal(filter.EventsVersionBatch))
+			Expect(events).To(Equal([]filter.MetricEvent{{
+				Metric:  "cpu;host=web1;dc=east",
+				Pattern: "cpu;*",
+				Point: &filter.EventPoint{
+					Value:              12,
+					Timestamp:          1234567890,
+					RetentionTimestamp: 1234567920,
+					Retention:          60,
+					Tags:               map[string]string{"host": "web1", "dc": "east"},
+				},
+			}}))
+		})
+	})
+
+	Context("When binary encoding is used", func() {
+		It("should decode basic events", func() {
+			connector.EventsEncoding = filter.EventsEncodingBinary
+			save(map[string][]string{"Simple.one": {"Simple.*"}})
+			data := conn.arguments["PUBLISH"][1].([]byte)
+			version, events, err := filter.DecodeBinaryEvents(data)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(version).To(Equal(filter.EventsVersionSingle))
+			Expect(events).To(Equal([]filter.MetricEvent{{Metric: "Simple.one", Pattern: "Simple.*"}}))
+
+			_, _, err = filter.DecodeBinaryEvents(data[:len(data)-1])
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
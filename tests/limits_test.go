@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection limits", func() {
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+	})
+
+	It("should allow burst and delay events over rate", func() {
+		bucket := filter.NewTokenBucket(2)
+		now := time.Unix(1234567890, 0)
+		Expect(bucket.Reserve(now)).To(BeZero())
+		Expect(bucket.Reserve(now)).To(BeZero())
+		Expect(bucket.Reserve(now)).To(Equal(500 * time.Millisecond))
+		Expect(bucket.Reserve(now.Add(time.Second))).To(BeZero())
+		Expect(bucket.Reserve(now.Add(time.Second))).To(Equal(500 * time.Millisecond))
+	})
+
+	It("should refuse connections over limit", func() {
+		limiter := filter.NewConnectionLimiter(filter.ConnectionLimits{MaxConnections: 1})
+		first, err := limiter.Open("10.0.0.1")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = limiter.Open("10.0.0.2")
+		Expect(err).To(Equal(filter.ErrTooManyConnections))
+		Expect(filter.RejectedConnections.Count()).To(Equal(int64(1)))
+		first.Close()
+		first.Close()
+		_, err = limiter.Open("10.0.0.2")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should throttle lines of source over all its connections", func() {
+		limiter := filter.NewConnectionLimiter(filter.ConnectionLimits{IPLineRate: 100})
+		first, err := limiter.Open("10.0.0.1")
+		Expect(err).ShouldNot(HaveOccurred())
+		second, err := limiter.Open("10.0.0.1")
+		Expect(err).ShouldNot(HaveOccurred())
+		other, err := limiter.Open("10.0.0.2")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		started := time.Now()
+		for i := 0; i < 55; i++ {
+			first.Wait()
+			second.Wait()
+			other.Wait()
+		}
+		Expect(time.Since(started)).To(BeNumerically(">=", 90*time.Millisecond))
+
+		sources := limiter.Sources()
+		Expect(sources).To(HaveLen(2))
+		Expect(sources[0].Source).To(Equal("10.0.0.1"))
+		Expect(sources[0].Connections).To(Equal(int64(2)))
+		Expect(sources[0].Lines).To(Equal(int64(110)))
+		Expect(sources[0].Throttled).To(BeNumerically(">=", 9))
+		Expect(sources[1].Throttled).To(BeZero())
+		Expect(filter.ThrottledLines.Count()).To(Equal(sources[0].Throttled))
+	})
+
+	It("should count dropped lines by source", func() {
+		limiter := filter.NewConnectionLimiter(filter.ConnectionLimits{MaxLineLength: 10})
+		connection, err := limiter.Open("10.0.0.1")
+		Expect(err).ShouldNot(HaveOccurred())
+		before := filter.DroppedCount(filter.DropReasonLineTooLong)
+		connection.Drop()
+		connection.Close()
+		Expect(filter.DroppedCount(filter.DropReasonLineTooLong)).To(Equal(before + 1))
+		sources := limiter.Sources()
+		Expect(sources).To(HaveLen(1))
+		Expect(sources[0].Connections).To(BeZero())
+		Expect(sources[0].Dropped).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moira-alert/cache/api"
+	"github.com/moira-alert/cache/logging"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logging", func() {
+	var (
+		dir    string
+		path   string
+		output logging.Output
+	)
+
+	readLines := func(path string) []string {
+		data, err := ioutil.ReadFile(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logging")
+		Expect(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(dir, "cache.log")
+		output, err = logging.NewOutput("file", path)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		output.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should write logfmt lines not below level", func() {
+		logger := logging.New(logging.InfoLevel, logging.LogfmtFormat, output)
+		logger.Debugf("hidden")
+		logger.WithFields(logging.Fields{"source": "10.0.0.1:4242"}).Warningf("cannot parse %s", "input")
+		lines := readLines(path)
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(HavePrefix("time="))
+		Expect(lines[0]).To(ContainSubstring(" level=warning pid="))
+		Expect(lines[0]).To(ContainSubstring(" caller=logging_test.go:"))
+		Expect(lines[0]).To(HaveSuffix(` msg="cannot parse input" source=10.0.0.1:4242`))
+	})
+
+	It("should write JSON lines", func() {
+		logger := logging.New(logging.DebugLevel, logging.JSONFormat, output)
+		logger.WithFields(logging.Fields{"count": 3}).Debugf("replayed")
+		lines := readLines(path)
+		Expect(lines).To(HaveLen(1))
+		var result map[string]interface{}
+		Expect(json.Unmarshal([]byte(lines[0]), &result)).To(Succeed())
+		Expect(result["level"]).To(Equal("debug"))
+		Expect(result["msg"]).To(Equal("replayed"))
+		Expect(result["count"]).To(Equal(float64(3)))
+		Expect(result["pid"]).To(Equal(float64(os.Getpid())))
+	})
+
+	It("should change level of derived loggers", func() {
+		logger := logging.New(logging.ErrorLevel, logging.LogfmtFormat, output)
+		derived := logger.WithFields(logging.Fields{"source": "test"})
+		derived.Infof("hidden")
+		logger.SetLevel(logging.InfoLevel)
+		derived.Infof("shown")
+		lines := readLines(path)
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(ContainSubstring("msg=shown"))
+	})
+
+	It("should reopen rotated file", func() {
+		logger := logging.New(logging.InfoLevel, logging.LogfmtFormat, output)
+		logger.Infof("before")
+		Expect(os.Rename(path, path+".1")).To(Succeed())
+		logger.Infof("rotated")
+		Expect(logger.Reopen()).To(Succeed())
+		logger.Infof("after")
+		Expect(readLines(path + ".1")).To(HaveLen(2))
+		lines := readLines(path)
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(ContainSubstring("msg=after"))
+	})
+
+	It("should parse config names", func() {
+		level, err := logging.ParseLevel("warn")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(level).To(Equal(logging.WarningLevel))
+		_, err = logging.ParseLevel("verbose")
+		Expect(err).Should(HaveOccurred())
+		_, err = logging.ParseFormat("xml")
+		Expect(err).Should(HaveOccurred())
+		_, err = logging.NewOutput("syslog", "")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should serve and change level", func() {
+		logger := logging.New(logging.InfoLevel, logging.LogfmtFormat, output)
+		handler := api.LogLevelHandler(logger, "secret")
+		put := func(level, token string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("PUT", "/loglevel?level="+level, nil)
+			if token != "" {
+				request.Header.Set("Authorization", "Bearer "+token)
+			}
+			handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		recorder := put("debug", "secret")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"level":"debug"}`))
+		Expect(logger.Level()).To(Equal(logging.DebugLevel))
+
+		Expect(put("loud", "secret").Code).To(Equal(http.StatusBadRequest))
+		Expect(logger.Level()).To(Equal(logging.DebugLevel))
+	})
+
+	It("should not change level without valid token", func() {
+		logger := logging.New(logging.InfoLevel, logging.LogfmtFormat, output)
+		handler := api.LogLevelHandler(logger, "secret")
+		for _, header := range []string{"", "Bearer wrong", "secret"} {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("PUT", "/loglevel?level=debug", nil)
+			request.Header.Set("Authorization", header)
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		}
+		Expect(logger.Level()).To(Equal(logging.InfoLevel))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/loglevel", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	It("should change level from loopback clients only if token is not configured", func() {
+		logger := logging.New(logging.InfoLevel, logging.LogfmtFormat, output)
+		handler := api.LogLevelHandler(logger, "")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("PUT", "/loglevel?level=debug", nil))
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		request := httptest.NewRequest("PUT", "/loglevel?level=debug", nil)
+		request.RemoteAddr = "127.0.0.1:34567"
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(logger.Level()).To(Equal(logging.DebugLevel))
+	})
+})
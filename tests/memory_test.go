@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory storage", func() {
+	var (
+		storage  *filter.MemoryStorage
+		cache    *filter.CacheStorage
+		patterns *filter.PatternStorage
+	)
+
+	save := func(metric string, value float64, timestamp int64) {
+		buffer := make(map[string]*filter.MatchedMetric)
+		cache.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+			Metric:    metric,
+			Patterns:  patterns.MatchPattern([]byte(metric)),
+			Value:     value,
+			Timestamp: timestamp,
+		})
+		Expect(cache.SavePoints(buffer, storage)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		storage = filter.NewMemoryStorage("Simple.*")
+		patterns = filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(storage)).To(Succeed())
+		var err error
+		cache, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("[default]\npattern = .*\nretentions = 60:7d\n")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should provide patterns", func() {
+		Expect(patterns.MatchPattern([]byte("Simple.one"))).To(Equal([]string{"Simple.*"}))
+		storage.SetPatterns("Complex.*")
+		Expect(patterns.DoRefresh(storage)).To(Succeed())
+		Expect(patterns.MatchPattern([]byte("Simple.one"))).To(BeEmpty())
+	})
+
+	It("should save points, retentions and events", func() {
+		save("Simple.one", 1, 1234567800)
+		save("Simple.one", 2, 1234567860)
+		Expect(storage.Points("Simple.one")).To(Equal([]filter.MetricPoint{{Timestamp: 1234567800, Value: 1}, {Timestamp: 1234567860, Value: 2}}))
+		retention, ok := storage.Retention("Simple.one")
+		Expect(ok).To(BeTrue())
+		Expect(retention).To(Equal(60))
+		Expect(storage.Events()).To(Equal([]filter.MetricEvent{{Metric: "Simple.one", Pattern: "Simple.*"}, {Metric: "Simple.one", Pattern: "Simple.*"}}))
+	})
+
+	It("should trim points older than metrics ttl", func() {
+		storage.MetricsTTL = 60
+		save("Simple.one", 1, 1234567800)
+		save("Simple.one", 2, 1234567860)
+		save("Simple.one", 3, 1234567920)
+		Expect(storage.Points("Simple.one")).To(Equal([]filter.MetricPoint{{Timestamp: 1234567860, Value: 2}, {Timestamp: 1234567920, Value: 3}}))
+	})
+
+	It("should remove metrics without points newer than metrics ttl", func() {
+		storage.MetricsTTL = 60
+		save("Simple.one", 1, 1234567800)
+		save("Simple.two", 1, 1234567800)
+		save("Simple.two", 2, 1234567920)
+		Expect(storage.Points("Simple.one")).NotTo(BeEmpty())
+
+		storage.ExpireMetrics()
+		Expect(storage.Points("Simple.one")).To(BeEmpty())
+		_, ok := storage.Retention("Simple.one")
+		Expect(ok).To(BeFalse())
+		Expect(storage.Points("Simple.two")).To(Equal([]filter.MetricPoint{{Timestamp: 1234567920, Value: 2}}))
+	})
+
+	It("should keep only last events", func() {
+		storage.EventsLimit = 1
+		save("Simple.one", 1, 1234567800)
+		save("Simple.two", 1, 1234567800)
+		Expect(storage.Events()).To(Equal([]filter.MetricEvent{{Metric: "Simple.two", Pattern: "Simple.*"}}))
+	})
+
+	It("should count heartbeats", func() {
+		Expect(storage.UpdateMetricsHeartbeat()).To(Succeed())
+		Expect(storage.Heartbeat()).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rcrowley/go-metrics"
+)
+
+var _ = Describe("Name filter", func() {
+	var patterns *filter.PatternStorage
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		patterns = filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(filter.NewMemoryStorage("*.*.*"))).To(Succeed())
+	})
+
+	process := func(lines ...string) []string {
+		passed := make([]string, 0)
+		for _, line := range lines {
+			if m := patterns.ProcessIncomingMetric([]byte(line)); m != nil {
+				passed = append(passed, m.Metric)
+			}
+		}
+		return passed
+	}
+
+	It("should drop metrics matching rules in deny mode and count them by rule", func() {
+		nameFilter, err := filter.NewNameFilter(filter.FilterDeny, []string{"Noisy.*.debug"}, []string{`^tmp\.`, `debug$`})
+		Expect(err).ShouldNot(HaveOccurred())
+		patterns.SetStages(nameFilter)
+		before := filter.DroppedCount(filter.DropReasonFilter)
+
+		Expect(process(
+			"Noisy.host.debug 1 1234567890",
+			"tmp.host.cpu 1 1234567890",
+			"Other.host.debug 1 1234567890",
+			"Other.host.cpu 1 1234567890",
+		)).To(Equal([]string{"Other.host.cpu"}))
+
+		Expect(filter.DroppedCount(filter.DropReasonFilter)).To(Equal(before + 3))
+		Expect(nameFilter.Stats()).To(Equal([]filter.FilterRuleStats{
+			{Type: "glob", Pattern: "Noisy.*.debug", Matched: 1},
+			{Type: "regexp", Pattern: `^tmp\.`, Matched: 1},
+			{Type: "regexp", Pattern: `debug$`, Matched: 1},
+		}))
+	})
+
+	It("should count matched metrics by rule meters", func() {
+		nameFilter, err := filter.NewNameFilter(filter.FilterDeny, []string{"Noisy.*.debug"}, []string{`^tmp\.`})
+		Expect(err).ShouldNot(HaveOccurred())
+		patterns.SetStages(nameFilter)
+		first := metrics.GetOrRegisterMeter("filter.rule1.matched", metrics.DefaultRegistry)
+		second := metrics.GetOrRegisterMeter("filter.rule2.matched", metrics.DefaultRegistry)
+		firstBefore, secondBefore := first.Count(), second.Count()
+
+		process("Noisy.host.debug 1 1234567890", "tmp.host.cpu 1 1234567890", "tmp.host.mem 1 1234567890")
+		Expect(first.Count() - firstBefore).To(Equal(int64(1)))
+		Expect(second.Count() - secondBefore).To(Equal(int64(2)))
+	})
+
+	It("should pass only metrics matching rules in allow mode", func() {
+		nameFilter, err := filter.NewNameFilter(filter.FilterAllow, []string{"{Prod,Stage}.*.cpu"}, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		patterns.SetStages(nameFilter)
+
+		Expect(process(
+			"Prod.host.cpu 1 1234567890",
+			"Stage.host.cpu 1 1234567890",
+			"Dev.host.cpu 1 1234567890",
+		)).To(Equal([]string{"Prod.host.cpu", "Stage.host.cpu"}))
+		Expect(nameFilter.Stats()[0].Matched).To(Equal(int64(2)))
+	})
+
+	It("should reject invalid rules and modes", func() {
+		_, err := filter.NewNameFilter(filter.FilterDeny, nil, []string{"(broken"})
+		Expect(err).Should(HaveOccurred())
+		_, err = filter.ParseFilterMode("block")
+		Expect(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("New names limiter", func() {
+	var patterns *filter.PatternStorage
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		patterns = filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(filter.NewMemoryStorage("New.*"))).To(Succeed())
+	})
+
+	process := func(names ...string) []string {
+		passed := make([]string, 0)
+		for _, name := range names {
+			if m := patterns.ProcessIncomingMetric([]byte(name + " 1 1234567890")); m != nil {
+				passed = append(passed, m.Metric)
+			}
+		}
+		return passed
+	}
+
+	It("should drop new names over the rate and pass known ones", func() {
+		limiter := filter.NewNewNamesLimiter(2, time.Hour, 0)
+		patterns.SetMatchedStages(limiter)
+		before := filter.DroppedCount(filter.DropReasonNewNames)
+
+		Expect(process("New.one", "New.two", "New.three", "New.one", "New.two")).To(Equal([]string{"New.one", "New.two", "New.one", "New.two"}))
+		Expect(filter.DroppedCount(filter.DropReasonNewNames) - before).To(Equal(int64(1)))
+		Expect(limiter.Known()).To(Equal(2))
+	})
+
+	It("should remember names received within ttl", func() {
+		limiter := filter.NewNewNamesLimiter(1, 50*time.Millisecond, 0)
+		patterns.SetMatchedStages(limiter)
+		Expect(process("New.one")).To(Equal([]string{"New.one"}))
+		time.Sleep(60 * time.Millisecond)
+		Expect(process("New.one")).To(Equal([]string{"New.one"}))
+		Expect(limiter.Known()).To(Equal(1))
+	})
+
+	It("should not spend new names rate on names not matched by any pattern", func() {
+		limiter := filter.NewNewNamesLimiter(1, time.Hour, 0)
+		patterns.SetMatchedStages(limiter)
+		before := filter.DroppedCount(filter.DropReasonNewNames)
+
+		Expect(process("Other.one", "Other.two", "New.one")).To(Equal([]string{"New.one"}))
+		Expect(filter.DroppedCount(filter.DropReasonNewNames) - before).To(BeZero())
+		Expect(limiter.Known()).To(Equal(1))
+	})
+
+	It("should accept known names after restart during warmup and limit new ones after it", func() {
+		names := []string{"New.one", "New.two", "New.three"}
+		limiter := filter.NewNewNamesLimiter(1, time.Hour, 0)
+		patterns.SetMatchedStages(limiter)
+		Expect(process(names...)).To(Equal([]string{"New.one"}))
+
+		limiter = filter.NewNewNamesLimiter(1, time.Hour, 50*time.Millisecond)
+		patterns.SetMatchedStages(limiter)
+		before := filter.DroppedCount(filter.DropReasonNewNames)
+		Expect(process(names...)).To(Equal(names))
+		Expect(limiter.Known()).To(Equal(3))
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(process(names...)).To(Equal(names))
+		Expect(process("New.four", "New.five")).To(Equal([]string{"New.four"}))
+		Expect(filter.DroppedCount(filter.DropReasonNewNames) - before).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// respServer accepts redis protocol connections, records commands and answers them with reply func
+type respServer struct {
+	sync.Mutex
+	listener    net.Listener
+	commands    []string
+	subscribers []net.Conn
+	reply       func(args []string) string
+}
+
+func newRespServer(reply func(args []string) string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ShouldNot(HaveOccurred())
+	server := &respServer{listener: listener, reply: reply}
+	go server.serve()
+	return server
+}
+
+func (server *respServer) addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *respServer) received() []string {
+	server.Lock()
+	defer server.Unlock()
+	return append([]string(nil), server.commands...)
+}
+
+func (server *respServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+// subscribed returns number of connections subscribed to channels
+func (server *respServer) subscribed() int {
+	server.Lock()
+	defer server.Unlock()
+	return len(server.subscribers)
+}
+
+// publish sends message to every subscribed connection
+func (server *respServer) publish(channel, message string) {
+	server.Lock()
+	defer server.Unlock()
+	for _, conn := range server.subscribers {
+		fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(message), message)
+	}
+}
+
+func (server *respServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		server.Lock()
+		server.commands = append(server.commands, strings.Join(args, " "))
+		if strings.ToUpper(args[0]) == "SUBSCRIBE" {
+			server.subscribers = append(server.subscribers, conn)
+		}
+		server.Unlock()
+		fmt.Fprint(conn, server.reply(args))
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSpace(arg))
+	}
+	return args, nil
+}
+
+var _ = Describe("Redis connection options", func() {
+	var server *respServer
+
+	AfterEach(func() {
+		server.listener.Close()
+	})
+
+	Context("When password and db are configured", func() {
+		It("should authenticate and select db", func() {
+			server = newRespServer(func(args []string) string { return "+OK\r\n" })
+			c, err := filter.DialRedis(server.addr(), &filter.RedisOptions{
+				DbID:        2,
+				Username:    "moira",
+				Password:    "secret",
+				ReadTimeout: time.Second,
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			c.Close()
+			Expect(server.received()).To(Equal([]string{"AUTH moira secret", "SELECT 2"}))
+		})
+	})
+
+	Context("When db can not be selected", func() {
+		It("should fail to connect", func() {
+			server = newRespServer(func(args []string) string {
+				if args[0] == "SELECT" {
+					return "-ERR DB index is out of range\r\n"
+				}
+				return "+OK\r\n"
+			})
+			_, err := filter.DialRedis(server.addr(), &filter.RedisOptions{DbID: 100})
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("DB index is out of range"))
+		})
+	})
+
+	Context("When password is wrong", func() {
+		It("should fail startup check", func() {
+			server = newRespServer(func(args []string) string {
+				return "-WRONGPASS invalid username-password pair\r\n"
+			})
+			connector := filter.NewDbConnector(filter.NewRedisPoolWithOptions(server.addr(), &filter.RedisOptions{Password: "wrong"}))
+			Expect(connector.Ping()).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/moira-alert/cache/api"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rejected lines", func() {
+	var patterns *filter.PatternStorage
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		patterns = filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(filter.NewMemoryStorage("Simple.*"))).To(Succeed())
+	})
+
+	It("should classify parse errors", func() {
+		for line, class := range map[string]string{
+			"Simple.мetric 1 1234567890":   filter.ParseErrorNonASCII,
+			"Simple.metric 1 1234567890 1": filter.ParseErrorTooManyItems,
+			"Simple.metric 1":              filter.ParseErrorTooFewItems,
+			" 1 1234567890":                filter.ParseErrorEmptyName,
+			"Simple.metric one 1234567890": filter.ParseErrorBadValue,
+			"Simple.metric 1 now":          filter.ParseErrorBadTimestamp,
+		} {
+			_, _, _, err := filter.ParseMetricFromString([]byte(line))
+			parseErr, ok := err.(*filter.ParseError)
+			Expect(ok).To(BeTrue(), "failed line: '%s'", line)
+			Expect(parseErr.Class).To(Equal(class), "failed line: '%s'", line)
+		}
+	})
+
+	It("should truncate long lines in error text", func() {
+		line := "Simple.metric " + strings.Repeat("1", 10000) + "x 1234567890"
+		_, _, _, err := filter.ParseMetricFromString([]byte(line))
+		Expect(err).Should(HaveOccurred())
+		Expect(len(err.Error())).To(BeNumerically("<", 600))
+		Expect(err.Error()).To(HaveSuffix("' (invalid syntax)"))
+	})
+
+	It("should count rejects by class and keep them with source", func() {
+		before := filter.RejectedCount(filter.ParseErrorBadValue)
+		Expect(patterns.ProcessIncomingMetricFrom([]byte("Simple.metric one 1234567890"), "10.0.0.1:4242")).To(BeNil())
+		Expect(filter.RejectedCount(filter.ParseErrorBadValue)).To(Equal(before + 1))
+
+		recent := filter.Rejects.Recent()
+		Expect(recent).NotTo(BeEmpty())
+		last := recent[len(recent)-1]
+		Expect(last.Source).To(Equal("10.0.0.1:4242"))
+		Expect(last.Class).To(Equal(filter.ParseErrorBadValue))
+		Expect(last.Line).To(Equal("Simple.metric one 1234567890"))
+	})
+
+	It("should keep only recent rejects", func() {
+		rejects := filter.NewRejectLog(2, 0)
+		for _, line := range []string{"first", "second", "third"} {
+			_, _, _, err := filter.ParseMetricFromString([]byte(line))
+			rejects.Add([]byte(line), "", err)
+		}
+		recent := rejects.Recent()
+		Expect(recent).To(HaveLen(2))
+		Expect(recent[0].Line).To(Equal("second"))
+		Expect(recent[1].Line).To(Equal("third"))
+	})
+
+	It("should serve recent rejects", func() {
+		rejects := filter.NewRejectLog(10, 0)
+		_, _, _, err := filter.ParseMetricFromString([]byte("broken"))
+		rejects.Add([]byte("broken"), "10.0.0.1:4242", err)
+
+		recorder := httptest.NewRecorder()
+		api.RejectsHandler(rejects).ServeHTTP(recorder, httptest.NewRequest("GET", "/rejects", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var result []filter.Reject
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &result)).To(Succeed())
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Class).To(Equal(filter.ParseErrorTooFewItems))
+		Expect(result[0].Source).To(Equal("10.0.0.1:4242"))
+	})
+})
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// scriptedConn replies to commands with configured errors before succeeding
+type scriptedConn struct {
+	pending   []string
+	errors    map[string][]error
+	executed  []string
+	arguments map[string][]interface{}
+}
+
+func (c *scriptedConn) Close() error { return nil }
+func (c *scriptedConn) Err() error   { return nil }
+func (c *scriptedConn) Flush() error { return nil }
+
+func (c *scriptedConn) Send(command string, args ...interface{}) error {
+	c.pending = append(c.pending, command)
+	if c.arguments == nil {
+		c.arguments = make(map[string][]interface{})
+	}
+	c.arguments[command] = args
+	return nil
+}
+
+func (c *scriptedConn) Receive() (interface{}, error) {
+	command := c.pending[0]
+	c.pending = c.pending[1:]
+	if errs := c.errors[command]; len(errs) > 0 {
+		c.errors[command] = errs[1:]
+		return nil, errs[0]
+	}
+	c.executed = append(c.executed, command)
+	return "OK", nil
+}
+
+func (c *scriptedConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "" {
+		return nil, nil
+	}
+	c.Send(command, args...)
+	return c.Receive()
+}
+
+var _ = Describe("Saving retries", func() {
+	var (
+		conn      *scriptedConn
+		connector *filter.DbConnector
+		storage   *filter.CacheStorage
+	)
+
+	save := func() error {
+		buffer := make(map[string]*filter.MatchedMetric)
+		storage.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+			Metric:    "Simple.metric",
+			Patterns:  []string{"Simple.*"},
+			Value:     12,
+			Timestamp: 1234567890,
+		})
+		return storage.SavePoints(buffer, connector)
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		conn = &scriptedConn{errors: make(map[string][]error)}
+		connector = filter.NewDbConnector(&redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		})
+		connector.RetryBackoff = time.Millisecond
+		var err error
+		storage, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("When command fails with transient error", func() {
+		It("should retry only failed command", func() {
+			conn.errors["ZADD"] = []error{redis.Error("LOADING Redis is loading the dataset in memory")}
+			Expect(save()).To(Succeed())
+			Expect(conn.executed).To(Equal([]string{"SET", "ZADD", "PUBLISH"}))
+		})
+	})
+
+	Context("When command fails with permanent error", func() {
+		It("should not retry it", func() {
+			conn.errors["SET"] = []error{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}
+			Expect(save()).To(Succeed())
+			Expect(conn.executed).To(Equal([]string{"ZADD", "PUBLISH"}))
+		})
+	})
+
+	Context("When events can not be published", func() {
+		It("should not fail saved points", func() {
+			errs := make([]error, connector.MaxRetries+1)
+			for i := range errs {
+				errs[i] = redis.Error("LOADING Redis is loading the dataset in memory")
+			}
+			conn.errors["PUBLISH"] = errs
+			Expect(save()).To(Succeed())
+			Expect(conn.executed).To(Equal([]string{"ZADD", "SET"}))
+			Expect(filter.FailedEvents.Count()).To(Equal(int64(1)))
+		})
+	})
+
+	Context("When retries are exhausted", func() {
+		It("should return error without publishing events", func() {
+			errs := make([]error, connector.MaxRetries+1)
+			for i := range errs {
+				errs[i] = redis.Error("OOM command not allowed when used memory > 'maxmemory'")
+			}
+			conn.errors["ZADD"] = errs
+			Expect(save()).NotTo(Succeed())
+			Expect(conn.executed).To(Equal([]string{"SET"}))
+		})
+	})
+})
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/cache/api"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rewrite rules", func() {
+	parse := func(content string) []*filter.RewriteRule {
+		rules, err := filter.ParseRewriteRules(strings.NewReader(content))
+		Expect(err).ShouldNot(HaveOccurred())
+		return rules
+	}
+
+	It("should parse carbon rules file", func() {
+		rules := parse("# comment\n[pre]\n^servers\\.(\\w+)\\. = hosts.\\1.\n\n^old\\. = new.\n")
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].Pattern.String()).To(Equal(`^servers\.(\w+)\.`))
+		Expect(rules[0].Replacement).To(Equal("hosts.${1}."))
+	})
+
+	It("should reject invalid rules", func() {
+		for _, content := range []string{"[post]\n^a = b\n", "^a\n", "^(a = b\n"} {
+			_, err := filter.ParseRewriteRules(strings.NewReader(content))
+			Expect(err).Should(HaveOccurred(), "failed content: '%s'", content)
+		}
+	})
+
+	It("should rewrite names in order before matching", func() {
+		filter.InitGraphiteMetrics()
+		patterns := filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(filter.NewMemoryStorage("hosts.*.cpu"))).To(Succeed())
+		patterns.SetStages(filter.NewRewriterWithRules(parse("^servers\\. = hosts.\n^hosts\\.(\\w+)\\.processor$ = hosts.$1.cpu\n^drop\\..* =\n")))
+
+		m := patterns.ProcessIncomingMetric([]byte("servers.web1.processor 1 1234567890"))
+		Expect(m).NotTo(BeNil())
+		Expect(m.Metric).To(Equal("hosts.web1.cpu"))
+		Expect(m.Patterns).To(Equal([]string{"hosts.*.cpu"}))
+		Expect(patterns.ProcessIncomingMetric([]byte("drop.me 1 1234567890"))).To(BeNil())
+	})
+
+	It("should reload changed rules file and keep rules on error", func() {
+		dir, err := ioutil.TempDir("", "rewrite")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		fileName := filepath.Join(dir, "rewrite-rules.conf")
+		Expect(ioutil.WriteFile(fileName, []byte("^a\\. = b.\n"), 0644)).To(Succeed())
+
+		rewriter, err := filter.NewRewriter(fileName)
+		Expect(err).ShouldNot(HaveOccurred())
+		reloaded, err := rewriter.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reloaded).To(BeFalse())
+
+		Expect(ioutil.WriteFile(fileName, []byte("^a\\. = c.\n^b\\. = c.\n"), 0644)).To(Succeed())
+		reloaded, err = rewriter.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reloaded).To(BeTrue())
+		Expect(rewriter.Rules()).To(HaveLen(2))
+
+		Expect(ioutil.WriteFile(fileName, []byte("^(a = c.\n"), 0644)).To(Succeed())
+		future := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(fileName, future, future)).To(Succeed())
+		_, err = rewriter.Reload()
+		Expect(err).Should(HaveOccurred())
+		Expect(rewriter.Rules()).To(HaveLen(2))
+
+		reloaded, err = rewriter.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reloaded).To(BeFalse())
+
+		Expect(os.Remove(fileName)).To(Succeed())
+		_, err = rewriter.Reload()
+		Expect(err).Should(HaveOccurred())
+		_, err = rewriter.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rewriter.Rules()).To(HaveLen(2))
+	})
+
+	It("should split rules on the first ' = '", func() {
+		rules := parse("^tag=(\\w+)$ = tagged.\\1\n^a\\. = b=c.\n")
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].Pattern.String()).To(Equal("^tag=(\\w+)$"))
+		Expect(rules[0].Replacement).To(Equal("tagged.${1}"))
+		Expect(rules[1].Pattern.String()).To(Equal("^a\\."))
+		Expect(rules[1].Replacement).To(Equal("b=c."))
+	})
+
+	It("should serve dry run", func() {
+		rewriter := filter.NewRewriterWithRules(parse("^servers\\. = hosts.\n^other\\. = none.\n"))
+		recorder := httptest.NewRecorder()
+		api.RewriteHandler(rewriter).ServeHTTP(recorder, httptest.NewRequest("GET", "/rewrite?metric=servers.web1.cpu", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		result := &filter.RewriteResult{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Result).To(Equal("hosts.web1.cpu"))
+		Expect(result.Steps).To(HaveLen(1))
+		Expect(result.Steps[0].Pattern).To(Equal(`^servers\.`))
+
+		recorder = httptest.NewRecorder()
+		api.RewriteHandler(rewriter).ServeHTTP(recorder, httptest.NewRequest("GET", "/rewrite", nil))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+})
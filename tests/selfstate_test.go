@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Instance self-state", func() {
+	var (
+		conn      *scriptedConn
+		connector *filter.DbConnector
+	)
+
+	state := &filter.InstanceState{
+		Instance:      "cache1:2003",
+		Hostname:      "cache1",
+		Version:       "1.0",
+		StartTime:     1234567800,
+		LastReceived:  1234567890,
+		ReceivedRate:  100,
+		MatchedRate:   10,
+		PatternsCount: 3,
+		RedisLatency:  1500 * time.Microsecond,
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		conn = &scriptedConn{errors: make(map[string][]error)}
+		connector = filter.NewDbConnector(&redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		})
+	})
+
+	It("should write expiring instance hash and register instance", func() {
+		connector.SelfStateTTL = 30
+		Expect(connector.UpdateInstanceState(state)).To(Succeed())
+		Expect(conn.executed).To(Equal([]string{"HMSET", "EXPIRE", "ZADD", "ZREMRANGEBYSCORE"}))
+		Expect(conn.arguments["HMSET"]).To(Equal([]interface{}{
+			filter.GetInstanceStateDbKey("cache1:2003"),
+			"hostname", "cache1",
+			"version", "1.0",
+			"start_time", int64(1234567800),
+			"last_received", int64(1234567890),
+			"received_rate", "100.000",
+			"matched_rate", "10.000",
+			"patterns_count", 3,
+			"redis_latency_ms", "1.500",
+		}))
+		Expect(conn.arguments["EXPIRE"]).To(Equal([]interface{}{filter.GetInstanceStateDbKey("cache1:2003"), int64(30)}))
+		Expect(conn.arguments["ZADD"][0]).To(Equal("moira-selfstate:cache-instances"))
+		Expect(conn.arguments["ZADD"][2]).To(Equal("cache1:2003"))
+		Expect(conn.arguments["ZREMRANGEBYSCORE"]).To(Equal([]interface{}{
+			"moira-selfstate:cache-instances", "-inf", fmt.Sprintf("(%d", conn.arguments["ZADD"][1].(int64)-30),
+		}))
+	})
+
+	It("should keep aggregate heartbeat counter", func() {
+		Expect(connector.UpdateMetricsHeartbeat()).To(Succeed())
+		Expect(conn.arguments["INCR"]).To(Equal([]interface{}{"moira-selfstate:metrics-heartbeat"}))
+	})
+
+	It("should count patterns tree is built from", func() {
+		patterns := filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(filter.NewMemoryStorage("Simple.*", "Complex.*.one"))).To(Succeed())
+		Expect(patterns.PatternsCount()).To(Equal(2))
+	})
+})
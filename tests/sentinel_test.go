@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeMaster answers as redis master
+func fakeMaster() *respServer {
+	return newRespServer(func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return "*3\r\n$6\r\nmaster\r\n:0\r\n*0\r\n"
+		case "PING":
+			return "+PONG\r\n"
+		}
+		return "+OK\r\n"
+	})
+}
+
+// fakeSentinel answers master address which can be changed
+type fakeSentinel struct {
+	sync.Mutex
+	*respServer
+	master string
+}
+
+func newFakeSentinel(master string) *fakeSentinel {
+	sentinel := &fakeSentinel{master: master}
+	sentinel.respServer = newRespServer(func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "SENTINEL":
+			sentinel.Lock()
+			defer sentinel.Unlock()
+			if args[2] != "mymaster" || sentinel.master == "" {
+				return "*-1\r\n"
+			}
+			host, port, _ := net.SplitHostPort(sentinel.master)
+			return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		case "SUBSCRIBE":
+			return "*3\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n:1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	return sentinel
+}
+
+func (sentinel *fakeSentinel) setMaster(master string) {
+	sentinel.Lock()
+	defer sentinel.Unlock()
+	sentinel.master = master
+}
+
+var _ = Describe("Redis sentinel", func() {
+	var (
+		master   *respServer
+		sentinel *fakeSentinel
+	)
+
+	BeforeEach(func() {
+		master = fakeMaster()
+		sentinel = newFakeSentinel(master.addr())
+	})
+
+	AfterEach(func() {
+		master.listener.Close()
+		sentinel.listener.Close()
+	})
+
+	It("should discover master from the first answering sentinel with sentinel credentials", func() {
+		down, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ShouldNot(HaveOccurred())
+		down.Close()
+
+		resolver, err := filter.NewSentinelResolver([]string{down.Addr().String(), sentinel.addr()}, "mymaster",
+			&filter.RedisOptions{Password: "sentinel-secret", DbID: 3})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(resolver.Master()).To(Equal(master.addr()))
+		Expect(sentinel.received()).To(Equal([]string{"AUTH sentinel-secret", "SENTINEL get-master-addr-by-name mymaster"}))
+	})
+
+	It("should fail when sentinels do not know master", func() {
+		_, err := filter.NewSentinelResolver([]string{sentinel.addr()}, "othermaster", nil)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should re-resolve master after connection error", func() {
+		resolver, err := filter.NewSentinelResolver([]string{sentinel.addr()}, "mymaster", nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		pool := filter.NewSentinelPool(resolver, &filter.RedisOptions{})
+
+		newMaster := fakeMaster()
+		defer newMaster.listener.Close()
+		master.listener.Close()
+		sentinel.setMaster(newMaster.addr())
+
+		c := pool.Get()
+		_, err = c.Do("PING")
+		Expect(err).Should(HaveOccurred())
+		c.Close()
+		Expect(resolver.Master()).To(Equal(newMaster.addr()))
+
+		c = pool.Get()
+		defer c.Close()
+		Expect(c.Do("PING")).To(Equal("PONG"))
+		Expect(newMaster.received()).To(ContainElement("ROLE"))
+	})
+
+	It("should not use redis which is not master", func() {
+		replica := newRespServer(func(args []string) string {
+			return "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:6379\r\n$9\r\nconnected\r\n:0\r\n"
+		})
+		defer replica.listener.Close()
+		sentinel.setMaster(replica.addr())
+		resolver, err := filter.NewSentinelResolver([]string{sentinel.addr()}, "mymaster", nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		sentinel.setMaster(master.addr())
+
+		c := filter.NewSentinelPool(resolver, &filter.RedisOptions{}).Get()
+		_, err = c.Do("PING")
+		Expect(err).To(MatchError(fmt.Sprintf("redis [%s] is not master", replica.addr())))
+		c.Close()
+		Expect(resolver.Master()).To(Equal(master.addr()))
+	})
+
+	It("should follow +switch-master notifications of its master", func() {
+		resolver, err := filter.NewSentinelResolver([]string{sentinel.addr()}, "mymaster", nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		terminate := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go resolver.Watch(terminate, &wg)
+		defer func() {
+			close(terminate)
+			wg.Wait()
+		}()
+		Eventually(sentinel.subscribed).Should(Equal(1))
+
+		sentinel.publish("+switch-master", "othermaster 127.0.0.1 1 127.0.0.1 2")
+		sentinel.publish("+switch-master", "mymaster 127.0.0.1 1 127.0.0.1 6380")
+		Eventually(resolver.Master).Should(Equal("127.0.0.1:6380"))
+	})
+})
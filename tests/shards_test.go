@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rcrowley/go-metrics"
+)
+
+var _ = Describe("Save pipeline", func() {
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+	})
+
+	Context("When metrics are sent to shards", func() {
+		It("should route every metric to single shard", func() {
+			shards := filter.NewMetricShards(4, 100, filter.OverflowBlock)
+			for i := 0; i < 10; i++ {
+				for j := 0; j < 2; j++ {
+					shards.Send(&filter.MatchedMetric{Metric: fmt.Sprintf("Metric.%d", i)})
+				}
+			}
+			shards.Close()
+
+			owners := make(map[string]int)
+			total := 0
+			for index, ch := range shards.Channels {
+				for m := range ch {
+					total++
+					if owner, ok := owners[m.Metric]; ok {
+						Expect(owner).To(Equal(index), "failed metric: '%s'", m.Metric)
+					}
+					owners[m.Metric] = index
+				}
+			}
+			Expect(total).To(Equal(20))
+			Expect(owners).To(HaveLen(10))
+		})
+	})
+
+	Context("When shard buffer is full", func() {
+		fill := func(policy filter.OverflowPolicy) *filter.MetricShards {
+			shards := filter.NewMetricShards(1, 2, policy)
+			for i := 0; i < 3; i++ {
+				shards.Send(&filter.MatchedMetric{Metric: fmt.Sprintf("Metric.%d", i)})
+			}
+			shards.Close()
+			return shards
+		}
+
+		received := func(shards *filter.MetricShards) []string {
+			names := make([]string, 0)
+			for m := range shards.Channels[0] {
+				names = append(names, m.Metric)
+			}
+			return names
+		}
+
+		It("should drop the oldest metric", func() {
+			dropped := filter.DroppedCount(filter.DropReasonOverflowOldest)
+			shards := fill(filter.OverflowDropOldest)
+			Expect(received(shards)).To(Equal([]string{"Metric.1", "Metric.2"}))
+			Expect(filter.DroppedCount(filter.DropReasonOverflowOldest) - dropped).To(Equal(int64(1)))
+		})
+
+		It("should drop the newest metric", func() {
+			dropped := filter.DroppedCount(filter.DropReasonOverflowNewest)
+			shards := fill(filter.OverflowDropNewest)
+			Expect(received(shards)).To(Equal([]string{"Metric.0", "Metric.1"}))
+			Expect(filter.DroppedCount(filter.DropReasonOverflowNewest) - dropped).To(Equal(int64(1)))
+		})
+
+		It("should register dropped meters before anything is dropped", func() {
+			filter.InitGraphiteMetrics()
+			for _, reason := range []string{filter.DropReasonOverflowOldest, filter.DropReasonOverflowNewest, filter.DropReasonLineTooLong} {
+				Expect(metrics.DefaultRegistry.Get("dropped."+reason)).NotTo(BeNil(), "missing meter of '%s'", reason)
+			}
+		})
+
+		It("should reject unknown policy", func() {
+			_, err := filter.ParseOverflowPolicy("drop_everything")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When metrics are buffered", func() {
+		var (
+			storage *filter.CacheStorage
+			ch      chan *filter.MatchedMetric
+			saved   chan int
+			done    chan bool
+		)
+
+		BeforeEach(func() {
+			var err error
+			storage, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+			Expect(err).ShouldNot(HaveOccurred())
+			ch = make(chan *filter.MatchedMetric, 10)
+			saved = make(chan int, 10)
+			done = make(chan bool)
+		})
+
+		AfterEach(func() {
+			if ch != nil {
+				close(ch)
+				<-done
+			}
+		})
+
+		process := func() {
+			go func() {
+				defer close(done)
+				storage.ProcessMatchedMetrics(ch, func(buffer map[string]*filter.MatchedMetric) {
+					saved <- len(buffer)
+				})
+			}()
+		}
+
+		It("should save full batch at once", func() {
+			storage.BatchSize = 3
+			storage.FlushInterval = time.Hour
+			process()
+			for i := 0; i < 3; i++ {
+				ch <- &filter.MatchedMetric{Metric: fmt.Sprintf("Metric.%d", i), Timestamp: 1234567890}
+			}
+			Eventually(saved).Should(Receive(Equal(3)))
+		})
+
+		It("should flush incomplete batch by interval", func() {
+			storage.BatchSize = 100
+			storage.FlushInterval = 10 * time.Millisecond
+			process()
+			ch <- &filter.MatchedMetric{Metric: "Metric", Timestamp: 1234567890}
+			Eventually(saved).Should(Receive(Equal(1)))
+		})
+
+		It("should flush pending metrics when channel is closed", func() {
+			storage.BatchSize = 100
+			storage.FlushInterval = time.Hour
+			process()
+			ch <- &filter.MatchedMetric{Metric: "Metric.1", Timestamp: 1234567890}
+			ch <- &filter.MatchedMetric{Metric: "Metric.2", Timestamp: 1234567890}
+			Eventually(storage.Pending).Should(Equal(int64(2)))
+			close(ch)
+			ch = nil
+			<-done
+			Expect(saved).To(Receive(Equal(2)))
+			Expect(storage.Pending()).To(BeZero())
+		})
+	})
+
+	It("should count metrics waiting in shards", func() {
+		shards := filter.NewMetricShards(2, 10, filter.OverflowBlock)
+		for i := 0; i < 5; i++ {
+			shards.Send(&filter.MatchedMetric{Metric: fmt.Sprintf("Metric.%d", i)})
+		}
+		Expect(shards.Pending()).To(Equal(5))
+	})
+})
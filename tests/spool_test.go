@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spool", func() {
+	var dir string
+
+	batch := func(metrics ...string) map[string]*filter.MatchedMetric {
+		buffer := make(map[string]*filter.MatchedMetric)
+		for _, metric := range metrics {
+			buffer[metric] = &filter.MatchedMetric{
+				Metric:             metric,
+				Patterns:           []string{metric},
+				Value:              12,
+				Timestamp:          1234567890,
+				RetentionTimestamp: 1234567920,
+				Retention:          60,
+			}
+		}
+		return buffer
+	}
+
+	// appendRaw writes raw record with given header to the only spool segment
+	appendRaw := func(size, points uint32, body string) {
+		segments, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(segments).To(HaveLen(1))
+		file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], size)
+		binary.BigEndian.PutUint32(header[4:8], points)
+		_, err = file.Write(append(header, body...))
+		Expect(err).ShouldNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "moira-cache-spool")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("When batches are appended", func() {
+		It("should replay them in order", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Empty()).To(BeTrue())
+			for i := 0; i < 3; i++ {
+				Expect(spool.Append(batch(fmt.Sprintf("Metric.%d", i)))).To(Succeed())
+			}
+			Expect(spool.Empty()).To(BeFalse())
+
+			replayed := make([]*filter.MatchedMetric, 0)
+			count, err := spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				for _, m := range buffer {
+					replayed = append(replayed, m)
+				}
+				return nil
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(3)))
+			Expect(replayed).To(HaveLen(3))
+			for i, m := range replayed {
+				Expect(m.Metric).To(Equal(fmt.Sprintf("Metric.%d", i)))
+				Expect(m.RetentionTimestamp).To(Equal(int64(1234567920)))
+			}
+			Expect(spool.Empty()).To(BeTrue())
+		})
+
+		It("should keep non-finite values and read records with numeric values", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			points := batch("NaN", "Inf", "NegInf")
+			points["NaN"].Value = math.NaN()
+			points["Inf"].Value = math.Inf(1)
+			points["NegInf"].Value = math.Inf(-1)
+			Expect(spool.Append(points)).To(Succeed())
+			old := `[{"Metric":"Old","Patterns":["Old"],"Value":12.5,"Timestamp":1234567890,"RetentionTimestamp":1234567920,"Retention":60}]`
+			appendRaw(uint32(len(old)), 1, old)
+
+			replayed := make(map[string]float64)
+			count, err := spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				for metric, m := range buffer {
+					replayed[metric] = m.Value
+				}
+				return nil
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(4)))
+			Expect(math.IsNaN(replayed["NaN"])).To(BeTrue())
+			Expect(math.IsInf(replayed["Inf"], 1)).To(BeTrue())
+			Expect(math.IsInf(replayed["NegInf"], -1)).To(BeTrue())
+			Expect(replayed["Old"]).To(Equal(12.5))
+		})
+
+		It("should resume replay after failed batch", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Append(batch("First"))).To(Succeed())
+			Expect(spool.Append(batch("Second"))).To(Succeed())
+
+			replayed := make([]string, 0)
+			save := func(buffer map[string]*filter.MatchedMetric) error {
+				if _, ok := buffer["Second"]; ok && len(replayed) == 1 {
+					return errors.New("redis is down")
+				}
+				for metric := range buffer {
+					replayed = append(replayed, metric)
+				}
+				return nil
+			}
+			count, err := spool.Replay(save)
+			Expect(err).To(HaveOccurred())
+			Expect(count).To(Equal(int64(1)))
+
+			replayed = append(replayed, "retry")
+			count, err = spool.Replay(save)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(1)))
+			Expect(replayed).To(Equal([]string{"First", "retry", "Second"}))
+		})
+
+		It("should survive restart", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Append(batch("First", "Second"))).To(Succeed())
+
+			reopened, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(reopened.Empty()).To(BeFalse())
+			count, err := reopened.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				return nil
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(2)))
+		})
+	})
+
+	Context("When replay is interrupted by restart", func() {
+		It("should continue from the first not saved batch", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Append(batch("First"))).To(Succeed())
+			Expect(spool.Append(batch("Second"))).To(Succeed())
+			_, err = spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				if _, ok := buffer["Second"]; ok {
+					return errors.New("redis is down")
+				}
+				return nil
+			})
+			Expect(err).To(HaveOccurred())
+
+			reopened, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			replayed := make([]string, 0)
+			count, err := reopened.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				for metric := range buffer {
+					replayed = append(replayed, metric)
+				}
+				return nil
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(1)))
+			Expect(replayed).To(Equal([]string{"Second"}))
+			files, err := ioutil.ReadDir(dir)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+
+	Context("When spool is corrupted", func() {
+		It("should skip undecodable record", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Append(batch("First"))).To(Succeed())
+			appendRaw(3, 2, "xxx")
+			Expect(spool.Append(batch("Third"))).To(Succeed())
+
+			dropped := filter.DroppedCount(filter.DropReasonSpoolCorrupted)
+			replayed := make([]string, 0)
+			count, err := spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				for metric := range buffer {
+					replayed = append(replayed, metric)
+				}
+				return nil
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(2)))
+			Expect(replayed).To(Equal([]string{"First", "Third"}))
+			Expect(filter.DroppedCount(filter.DropReasonSpoolCorrupted) - dropped).To(Equal(int64(2)))
+			Expect(spool.Empty()).To(BeTrue())
+		})
+
+		It("should quarantine segment with damaged record header", func() {
+			spool, err := filter.NewSpool(dir, 0, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Append(batch("First"))).To(Succeed())
+			appendRaw(0xffffffff, 1, "")
+			Expect(spool.Append(batch("Lost"))).To(Succeed())
+
+			count, err := spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				return nil
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(int64(1)))
+			Expect(spool.Empty()).To(BeTrue())
+			corrupted, err := filepath.Glob(filepath.Join(dir, "*.spool.corrupted"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(corrupted).To(HaveLen(1))
+		})
+	})
+
+	Context("When spooled batches are too old", func() {
+		It("should drop them", func() {
+			spool, err := filter.NewSpool(dir, 0, time.Millisecond)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spool.Append(batch("Old"))).To(Succeed())
+			_, err = spool.Replay(func(buffer map[string]*filter.MatchedMetric) error {
+				return errors.New("redis is down")
+			})
+			Expect(err).To(HaveOccurred())
+
+			time.Sleep(10 * time.Millisecond)
+			dropped := filter.DroppedCount(filter.DropReasonSpoolExpired)
+			Expect(spool.Append(batch("New"))).To(Succeed())
+			Expect(filter.DroppedCount(filter.DropReasonSpoolExpired) - dropped).To(Equal(int64(1)))
+		})
+	})
+})
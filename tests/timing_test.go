@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipeline timings", func() {
+	var (
+		storage  *filter.MemoryStorage
+		patterns *filter.PatternStorage
+		cache    *filter.CacheStorage
+	)
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		storage = filter.NewMemoryStorage("Simple.*")
+		patterns = filter.NewPatternStorage()
+		Expect(patterns.DoRefresh(storage)).To(Succeed())
+		var err error
+		cache, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should time parsing and matching of every line by default", func() {
+		for _, line := range []string{"Simple.one 1 1234567890", "Other.one 1 1234567890", "broken line"} {
+			patterns.ProcessIncomingMetric([]byte(line))
+		}
+		Expect(filter.ParsingTimer.Count()).To(Equal(int64(3)))
+		Expect(filter.MatchingTimer.Count()).To(Equal(int64(2)))
+		Expect(filter.StagesTimer.Count()).To(Equal(int64(0)))
+	})
+
+	It("should time metric stages separately from matching", func() {
+		nameFilter, err := filter.NewNameFilter(filter.FilterDeny, []string{"Other.*"}, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		patterns.SetStages(nameFilter)
+		for _, line := range []string{"Simple.one 1 1234567890", "Other.one 1 1234567890"} {
+			patterns.ProcessIncomingMetric([]byte(line))
+		}
+		Expect(filter.StagesTimer.Count()).To(Equal(int64(2)))
+		Expect(filter.MatchingTimer.Count()).To(Equal(int64(1)))
+	})
+
+	Context("When every n-th line is timed", func() {
+		BeforeEach(func() {
+			filter.TimingSampleRate = 100
+		})
+
+		AfterEach(func() {
+			filter.TimingSampleRate = 1
+		})
+
+		It("should time parsing and matching of sampled lines only", func() {
+			for i := 0; i < 250; i++ {
+				patterns.ProcessIncomingMetric([]byte("Simple.one 1 1234567890"))
+			}
+			Expect(filter.ParsingTimer.Count()).To(Equal(int64(2)))
+			Expect(filter.MatchingTimer.Count()).To(Equal(int64(2)))
+		})
+	})
+
+	It("should time queue wait, batch size and end-to-end latency", func() {
+		m := patterns.ProcessIncomingMetric([]byte("Simple.one 1 1234567890"))
+		Expect(m).NotTo(BeNil())
+		Expect(m.ReceivedAt.IsZero()).To(BeFalse())
+		time.Sleep(time.Millisecond)
+
+		ch := make(chan *filter.MatchedMetric, 1)
+		ch <- m
+		close(ch)
+		cache.BatchSize = 1
+		cache.ProcessMatchedMetrics(ch, func(buffer map[string]*filter.MatchedMetric) {
+			Expect(cache.SavePoints(buffer, storage)).To(Succeed())
+		})
+
+		Expect(filter.QueueTimer.Count()).To(Equal(int64(1)))
+		Expect(filter.QueueTimer.Min()).To(BeNumerically(">=", int64(time.Millisecond)))
+		Expect(filter.BatchSize.Count()).To(Equal(int64(1)))
+		Expect(filter.BatchSize.Max()).To(Equal(int64(1)))
+		Expect(filter.EndToEndTimer.Count()).To(Equal(int64(1)))
+	})
+
+	It("should not time end-to-end latency of replayed points", func() {
+		buffer := map[string]*filter.MatchedMetric{"Simple.one": {Metric: "Simple.one", Patterns: []string{"Simple.*"}}}
+		Expect(cache.SavePoints(buffer, storage)).To(Succeed())
+		Expect(filter.EndToEndTimer.Count()).To(BeZero())
+	})
+})
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/moira-alert/cache/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metric points trimming", func() {
+	var (
+		conn      *scriptedConn
+		connector *filter.DbConnector
+		storage   *filter.CacheStorage
+	)
+
+	save := func() error {
+		buffer := make(map[string]*filter.MatchedMetric)
+		storage.EnrichMatchedMetric(buffer, &filter.MatchedMetric{
+			Metric:    "Simple.metric",
+			Patterns:  []string{"Simple.*"},
+			Value:     12,
+			Timestamp: 1234567890,
+		})
+		return storage.SavePoints(buffer, connector)
+	}
+
+	BeforeEach(func() {
+		filter.InitGraphiteMetrics()
+		conn = &scriptedConn{errors: make(map[string][]error)}
+		connector = filter.NewDbConnector(&redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return conn, nil
+			},
+		})
+		connector.RetryBackoff = time.Millisecond
+		connector.MetricsTTL = 3600
+		connector.KeyTTL = 7200
+		connector.TrimSampling = 1
+		var err error
+		storage, err = filter.NewCacheStorage(bufio.NewScanner(strings.NewReader("")))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("When ttls are configured", func() {
+		It("should trim old points and expire keys", func() {
+			Expect(save()).To(Succeed())
+			Expect(conn.executed).To(Equal([]string{"EVALSHA", "SET", "PUBLISH"}))
+
+			script := conn.arguments["EVALSHA"]
+			Expect(script[1:]).To(Equal([]interface{}{
+				1, filter.GetMetricDbKey("Simple.metric"), int64(1234567920), "1234567890 12", "1234564320", int64(7200),
+			}))
+			Expect(conn.arguments["SET"]).To(Equal([]interface{}{
+				filter.GetMetricRetentionDbKey("Simple.metric"), 60, "EX", int64(7200),
+			}))
+		})
+	})
+
+	Context("When script is not loaded", func() {
+		It("should fall back to EVAL", func() {
+			conn.errors["EVALSHA"] = []error{redis.Error("NOSCRIPT No matching script. Please use EVAL.")}
+			Expect(save()).To(Succeed())
+			Expect(conn.executed).To(Equal([]string{"SET", "EVAL", "PUBLISH"}))
+			Expect(conn.arguments["EVAL"][0]).To(ContainSubstring("ZREMRANGEBYSCORE"))
+		})
+	})
+})